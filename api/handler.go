@@ -2,6 +2,9 @@ package api
 
 import "github.com/cloudtask/cloudtask-agent/cache"
 import "github.com/cloudtask/cloudtask-agent/driver"
+import "github.com/cloudtask/cloudtask-agent/history"
+import "github.com/cloudtask/libtools/gzkwrapper"
+import "github.com/cloudtask/common/models"
 
 import (
 	"net/http"
@@ -34,35 +37,279 @@ func getJob(c *Context) error {
 		return c.JSON(http.StatusNotFound, response)
 	}
 
-	respData := GetJobBaseResponse{JobBase: jobBase}
+	driver := c.Get("Driver").(*driver.Driver)
+	respData := GetJobBaseResponse{JobBase: jobBase, Versions: driver.GetJobVersions(jobid)}
 	response.SetContent(ErrRequestSuccessed.Error())
 	response.SetData(respData)
 	return c.JSON(http.StatusOK, response)
 }
 
-func postJobsAlloc(c *Context) error {
+func getJobRuns(c *Context) error {
+
+	response := &ResponseImpl{}
+	jobid, limit := ResolveJobRunsRequest(c)
+	if jobid == "" {
+		response.SetContent(ErrRequestResolveInvaild.Error())
+		return c.JSON(http.StatusBadRequest, response)
+	}
+
+	store := c.Get("History").(*history.RunStore)
+	runs := store.GetRuns(jobid, limit)
+	respData := GetJobRunsResponse{JobId: jobid, Runs: runs}
+	response.SetContent(ErrRequestSuccessed.Error())
+	response.SetData(respData)
+	return c.JSON(http.StatusOK, response)
+}
+
+func getRun(c *Context) error {
 
-	return c.JSON(http.StatusAccepted, nil)
-	/*buf, err := ioutil.ReadAll(c.Request().Body)
+	response := &ResponseImpl{}
+	runid := ResolveRunRequest(c)
+	if runid == "" {
+		response.SetContent(ErrRequestResolveInvaild.Error())
+		return c.JSON(http.StatusBadRequest, response)
+	}
+
+	store := c.Get("History").(*history.RunStore)
+	run, output, err := store.GetRun(runid)
 	if err != nil {
-		//500
-		return nil
+		response.SetContent(ErrRequestNotFound.Error())
+		return c.JSON(http.StatusNotFound, response)
 	}
 
-	jobsAllocChanged := &models.JobsAllocChanged{}
-	if err := json.NewDecoder(bytes.NewBuffer(buf)).Decode(jobsAllocChanged); err != nil {
-		//400
-		return nil
+	respData := GetRunResponse{Run: run, Output: output}
+	response.SetContent(ErrRequestSuccessed.Error())
+	response.SetData(respData)
+	return c.JSON(http.StatusOK, response)
+}
+
+func postJobsAlloc(c *Context) error {
+
+	response := &ResponseImpl{}
+	if !authenticate(c.Request()) {
+		response.SetContent(ErrRequestUnauthorized.Error())
+		return c.JSON(http.StatusUnauthorized, response)
+	}
+
+	request := ResolveJobsAllocRequest(c)
+	if request == nil || request.Version <= 0 {
+		response.SetContent(ErrRequestResolveInvaild.Error())
+		return c.JSON(http.StatusBadRequest, response)
 	}
 
-	nodeKey := ""
 	nodeData := c.Get("NodeData").(*gzkwrapper.NodeData)
+	if request.Runtime != nodeData.Location {
+		response.SetContent(ErrRequestResolveInvaild.Error())
+		return c.JSON(http.StatusBadRequest, response)
+	}
+
 	cache := c.Get("Cache").(*cache.Cache)
-	cache.SetJobsAlloc(nodeKey)
+	originVersion := cache.GetAllocVersion()
+	if request.Version < originVersion { //已应用更新的分配表
+		response.SetContent(ErrRequestVersionInvalid.Error())
+		response.SetData(PostJobsAllocResponse{Version: originVersion})
+		return c.JSON(http.StatusConflict, response)
+	}
+
+	if request.Version == originVersion {
+		response.SetContent(ErrRequestSuccessed.Error())
+		response.SetData(PostJobsAllocResponse{Version: originVersion})
+		return c.JSON(http.StatusOK, response)
+	}
+
+	data, err := models.JobsAllocEnCode(&models.JobsAlloc{Version: request.Version, Jobs: request.Jobs})
+	if err != nil {
+		response.SetContent(ErrRequestServerException.Error())
+		return c.JSON(http.StatusInternalServerError, response)
+	}
+
+	//与zk watch相同的分配表处理流程
+	version, err := cache.SetAllocBuffer(c.Get("NodeKey").(string), data)
+	if err != nil {
+		response.SetContent(ErrRequestVersionInvalid.Error())
+		response.SetData(PostJobsAllocResponse{Version: cache.GetAllocVersion()})
+		return c.JSON(http.StatusConflict, response)
+	}
+
+	response.SetContent(ErrRequestAccepted.Error())
+	response.SetData(PostJobsAllocResponse{Version: version})
+	return c.JSON(http.StatusAccepted, response)
+}
+
+func getDrain(c *Context) error {
+
+	response := &ResponseImpl{}
+	driver := c.Get("Driver").(*driver.Driver)
+	respData := GetDrainResponse{Drain: driver.GetDrainStatus()}
+	response.SetContent(ErrRequestSuccessed.Error())
+	response.SetData(respData)
+	return c.JSON(http.StatusOK, response)
+}
+
+func getCache(c *Context) error {
+
+	response := &ResponseImpl{}
+	cache := c.Get("Cache").(*cache.Cache)
+	respData := GetCacheResponse{Cache: cache.GetStatus()}
+	response.SetContent(ErrRequestSuccessed.Error())
+	response.SetData(respData)
+	return c.JSON(http.StatusOK, response)
+}
+
+func getCacheJob(c *Context) error {
+
+	response := &ResponseImpl{}
+	jobid := ResolveJobBaseRequest(c)
+	if jobid == "" {
+		response.SetContent(ErrRequestResolveInvaild.Error())
+		return c.JSON(http.StatusBadRequest, response)
+	}
 
 	cache := c.Get("Cache").(*cache.Cache)
-	cache.SetJobsAlloc()
-	*/
+	status := cache.GetJobStatus(jobid)
+	if status == nil {
+		response.SetContent(ErrRequestNotFound.Error())
+		return c.JSON(http.StatusNotFound, response)
+	}
+
+	respData := GetCacheJobResponse{Job: status}
+	response.SetContent(ErrRequestSuccessed.Error())
+	response.SetData(respData)
+	return c.JSON(http.StatusOK, response)
+}
+
+func postCacheJobRepull(c *Context) error {
+
+	response := &ResponseImpl{}
+	if !authenticate(c.Request()) {
+		response.SetContent(ErrRequestUnauthorized.Error())
+		return c.JSON(http.StatusUnauthorized, response)
+	}
+
+	jobid := ResolveJobBaseRequest(c)
+	if jobid == "" {
+		response.SetContent(ErrRequestResolveInvaild.Error())
+		return c.JSON(http.StatusBadRequest, response)
+	}
+
+	driver := c.Get("Driver").(*driver.Driver)
+	err := c.Get("Cache").(*cache.Cache).RepullJob(jobid, driver)
+	if err == cache.ErrJobRunning { //正在执行时不删除工作目录
+		response.SetContent(ErrRequestJobRunning.Error())
+		return c.JSON(http.StatusConflict, response)
+	}
+
+	if err != nil {
+		response.SetContent(ErrRequestAllocNotFound.Error())
+		return c.JSON(http.StatusNotFound, response)
+	}
+
+	cache := c.Get("Cache").(*cache.Cache)
+
+	respData := GetCacheJobResponse{Job: cache.GetJobStatus(jobid)}
+	response.SetContent(ErrRequestAccepted.Error())
+	response.SetData(respData)
+	return c.JSON(http.StatusAccepted, response)
+}
+
+func postCacheVerify(c *Context) error {
+
+	response := &ResponseImpl{}
+	if !authenticate(c.Request()) {
+		response.SetContent(ErrRequestUnauthorized.Error())
+		return c.JSON(http.StatusUnauthorized, response)
+	}
+
+	driver := c.Get("Driver").(*driver.Driver)
+	cache := c.Get("Cache").(*cache.Cache)
+	respData := PostCacheVerifyResponse{Results: cache.VerifyJobs(driver)}
+	response.SetContent(ErrRequestSuccessed.Error())
+	response.SetData(respData)
+	return c.JSON(http.StatusOK, response)
+}
+
+func getCacheDownloads(c *Context) error {
+
+	response := &ResponseImpl{}
+	cache := c.Get("Cache").(*cache.Cache)
+	respData := GetCacheDownloadsResponse{Downloads: cache.GetDownloads()}
+	response.SetContent(ErrRequestSuccessed.Error())
+	response.SetData(respData)
+	return c.JSON(http.StatusOK, response)
+}
+
+func getCacheSources(c *Context) error {
+
+	response := &ResponseImpl{}
+	cache := c.Get("Cache").(*cache.Cache)
+	respData := GetCacheSourcesResponse{Sources: cache.GetSources()}
+	response.SetContent(ErrRequestSuccessed.Error())
+	response.SetData(respData)
+	return c.JSON(http.StatusOK, response)
+}
+
+func getCacheFile(c *Context) error {
+
+	response := &ResponseImpl{}
+	if !authenticate(c.Request()) {
+		response.SetContent(ErrRequestUnauthorized.Error())
+		return c.JSON(http.StatusUnauthorized, response)
+	}
+
+	filename := ResolveCacheFileRequest(c)
+	cache := c.Get("Cache").(*cache.Cache)
+	fd, err := cache.OpenJobFile(filename)
+	if err != nil {
+		response.SetContent(ErrRequestNotFound.Error())
+		return c.JSON(http.StatusNotFound, response)
+	}
+
+	defer fd.Close()
+	info, err := fd.Stat()
+	if err != nil || info.IsDir() {
+		response.SetContent(ErrRequestNotFound.Error())
+		return c.JSON(http.StatusNotFound, response)
+	}
+	//ServeContent支持Range请求, peer可断点续传
+	http.ServeContent(c.Response(), c.Request(), info.Name(), info.ModTime(), fd)
+	return nil
+}
+
+func postDrain(c *Context) error {
+
+	response := &ResponseImpl{}
+	if !authenticate(c.Request()) {
+		response.SetContent(ErrRequestUnauthorized.Error())
+		return c.JSON(http.StatusUnauthorized, response)
+	}
+
+	driver := c.Get("Driver").(*driver.Driver)
+	if driver.BeginDrain() {
+		go driver.WaitDrain()
+	}
+	respData := GetDrainResponse{Drain: driver.GetDrainStatus()}
+	response.SetContent(ErrRequestAccepted.Error())
+	response.SetData(respData)
+	return c.JSON(http.StatusAccepted, response)
+}
+
+func deleteDrain(c *Context) error {
+
+	response := &ResponseImpl{}
+	if !authenticate(c.Request()) {
+		response.SetContent(ErrRequestUnauthorized.Error())
+		return c.JSON(http.StatusUnauthorized, response)
+	}
+
+	driver := c.Get("Driver").(*driver.Driver)
+	if err := driver.ResumeDrain(); err != nil { //agent退出中
+		response.SetContent(err.Error())
+		return c.JSON(http.StatusConflict, response)
+	}
+	respData := GetDrainResponse{Drain: driver.GetDrainStatus()}
+	response.SetContent(ErrRequestSuccessed.Error())
+	response.SetData(respData)
+	return c.JSON(http.StatusOK, response)
 }
 
 func putJobAction(c *Context) error {
@@ -1,11 +1,13 @@
 package api
 
+import "github.com/cloudtask/common/models"
 import "github.com/gorilla/mux"
 
 import (
 	"bytes"
 	"encoding/json"
 	"io/ioutil"
+	"strconv"
 	"strings"
 )
 
@@ -20,6 +22,39 @@ func ResolveJobBaseRequest(c *Context) string {
 	return jobid
 }
 
+//ResolveRunRequest is exported
+func ResolveRunRequest(c *Context) string {
+
+	vars := mux.Vars(c.request)
+	runid := strings.TrimSpace(vars["runid"])
+	if len(runid) == 0 {
+		return ""
+	}
+	return runid
+}
+
+//ResolveCacheFileRequest is exported
+func ResolveCacheFileRequest(c *Context) string {
+
+	vars := mux.Vars(c.request)
+	return strings.TrimSpace(vars["filename"])
+}
+
+//ResolveJobRunsRequest is exported
+func ResolveJobRunsRequest(c *Context) (string, int) {
+
+	jobid := ResolveJobBaseRequest(c)
+	limit := 0
+	if value := strings.TrimSpace(c.Query("limit")); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return "", 0
+		}
+		limit = n
+	}
+	return jobid, limit
+}
+
 //ResolveJobActionRequest is exported
 func ResolveJobActionRequest(c *Context) *JobActionRequest {
 
@@ -34,3 +69,18 @@ func ResolveJobActionRequest(c *Context) *JobActionRequest {
 	}
 	return request
 }
+
+//ResolveJobsAllocRequest is exported
+func ResolveJobsAllocRequest(c *Context) *models.JobsAllocChanged {
+
+	buf, err := ioutil.ReadAll(c.Request().Body)
+	if err != nil {
+		return nil
+	}
+
+	request := &models.JobsAllocChanged{}
+	if err := json.NewDecoder(bytes.NewReader(buf)).Decode(request); err != nil {
+		return nil
+	}
+	return request
+}
@@ -1,5 +1,8 @@
 package api
 
+import "github.com/cloudtask/cloudtask-agent/cache"
+import "github.com/cloudtask/cloudtask-agent/driver"
+import "github.com/cloudtask/cloudtask-agent/history"
 import "github.com/cloudtask/common/models"
 
 import (
@@ -13,6 +16,9 @@ var (
 	ErrRequestNotFound        = errors.New("request resource not found.")
 	ErrRequestServerException = errors.New("request server exception.")
 	ErrRequestAllocNotFound   = errors.New("request resource not found in cache alloc.")
+	ErrRequestJobRunning      = errors.New("request job is running.")
+	ErrRequestUnauthorized    = errors.New("request unauthorized.")
+	ErrRequestVersionInvalid  = errors.New("request alloc version invalid.")
 )
 
 //HandleResponse is exportyed
@@ -45,5 +51,53 @@ type GetJobsBaseResponse struct {
 
 //GetJobBaseResponse is exported
 type GetJobBaseResponse struct {
-	JobBase *models.JobBase `json:"jobbase"`
+	JobBase  *models.JobBase     `json:"jobbase"`
+	Versions *driver.JobVersions `json:"versions"`
+}
+
+//GetJobRunsResponse is exported
+type GetJobRunsResponse struct {
+	JobId string               `json:"jobid"`
+	Runs  []*history.RunRecord `json:"runs"`
+}
+
+//GetRunResponse is exported
+type GetRunResponse struct {
+	Run    *history.RunRecord `json:"run"`
+	Output *history.RunOutput `json:"output"`
+}
+
+//PostJobsAllocResponse is exported
+type PostJobsAllocResponse struct {
+	Version int `json:"version"`
+}
+
+//GetDrainResponse is exported
+type GetDrainResponse struct {
+	Drain driver.DrainStatus `json:"drain"`
+}
+
+//GetCacheResponse is exported
+type GetCacheResponse struct {
+	Cache *cache.CacheStatus `json:"cache"`
+}
+
+//GetCacheJobResponse is exported
+type GetCacheJobResponse struct {
+	Job *cache.JobStatus `json:"job"`
+}
+
+//PostCacheVerifyResponse is exported
+type PostCacheVerifyResponse struct {
+	Results []*cache.VerifyResult `json:"results"`
+}
+
+//GetCacheSourcesResponse is exported
+type GetCacheSourcesResponse struct {
+	Sources []*cache.SourceStatus `json:"sources"`
+}
+
+//GetCacheDownloadsResponse is exported
+type GetCacheDownloadsResponse struct {
+	Downloads []*cache.DownloadProgress `json:"downloads"`
 }
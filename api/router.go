@@ -13,16 +13,30 @@ type handler func(c *Context) error
 
 var routes = map[string]map[string]handler{
 	"GET": {
-		"/cloudtask/v2/_ping":        ping,
-		"/cloudtask/v2/jobs":         getJobs,
-		"/cloudtask/v2/jobs/{jobid}": getJob,
+		"/cloudtask/v2/_ping":                  ping,
+		"/cloudtask/v2/jobs":                   getJobs,
+		"/cloudtask/v2/jobs/{jobid}":           getJob,
+		"/cloudtask/v2/jobs/{jobid}/runs":      getJobRuns,
+		"/cloudtask/v2/runs/{runid}":           getRun,
+		"/cloudtask/v2/drain":                  getDrain,
+		"/cloudtask/v2/cache":                  getCache,
+		"/cloudtask/v2/cache/jobs/{jobid}":     getCacheJob,
+		"/cloudtask/v2/cache/downloads":        getCacheDownloads,
+		"/cloudtask/v2/cache/sources":          getCacheSources,
+		"/cloudtask/v2/cache/files/{filename}": getCacheFile,
 	},
 	"POST": {
-		"/cloudtask/v2/jobsalloc": postJobsAlloc,
+		"/cloudtask/v2/jobsalloc":                 postJobsAlloc,
+		"/cloudtask/v2/drain":                     postDrain,
+		"/cloudtask/v2/cache/jobs/{jobid}/repull": postCacheJobRepull,
+		"/cloudtask/v2/cache/verify":              postCacheVerify,
 	},
 	"PUT": {
 		"/cloudtask/v2/jobs/action": putJobAction,
 	},
+	"DELETE": {
+		"/cloudtask/v2/drain": deleteDrain,
+	},
 }
 
 func NewRouter(enableCors bool, store Store) *mux.Router {
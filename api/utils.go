@@ -1,6 +1,12 @@
 package api
 
-import "net/http"
+import "github.com/cloudtask/cloudtask-agent/etc"
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
 
 func httpError(w http.ResponseWriter, err string, code int) {
 	http.Error(w, err, code)
@@ -11,3 +17,19 @@ func writeCorsHeaders(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept")
 	w.Header().Add("Access-Control-Allow-Methods", "GET, POST, DELETE, PUT, OPTIONS, HEAD")
 }
+
+//authenticate check request bearer token, all requests are refused when token is not configured.
+func authenticate(r *http.Request) bool {
+
+	token := etc.APIToken()
+	if token == "" {
+		return false
+	}
+
+	auth := strings.TrimSpace(r.Header.Get("Authorization"))
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	value := strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	return subtle.ConstantTimeCompare([]byte(value), []byte(token)) == 1
+}
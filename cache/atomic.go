@@ -0,0 +1,97 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	//job目录激活前的暂存目录前缀
+	stagingPrefix = ".staging-"
+	//原子写入的临时文件后缀
+	tempSuffix = ".tmp"
+)
+
+/*
+writeFileAtomic 原子写入文件
+先写入临时文件并fsync, 再rename为目标文件, 崩溃时不会留下写入一半的文件.
+*/
+func writeFileAtomic(fpath string, data []byte, perm os.FileMode) error {
+
+	temp := fpath + tempSuffix
+	fd, err := os.OpenFile(temp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err = fd.Write(data); err == nil {
+		err = fd.Sync()
+	}
+	fd.Close()
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+
+	if err := os.Rename(temp, fpath); err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return syncDirectory(filepath.Dir(fpath))
+}
+
+//stagingDirectory return the staging path of a job directory.
+func stagingDirectory(jobdirectory string) string {
+
+	return filepath.Dir(jobdirectory) + "/" + stagingPrefix + filepath.Base(jobdirectory)
+}
+
+/*
+activateDirectory 激活暂存目录
+fsync暂存目录(包括子目录)的目录项后rename为job目录, job目录只会是完整的内容或不存在.
+文件内容在写入时已fsync: 解压的blob文件、复制的文件(不支持硬链接时)与原子写入的命令文件,
+硬链接只增加目录项, 由目录fsync保证.
+*/
+func activateDirectory(staging string, jobdirectory string) error {
+
+	err := filepath.Walk(staging, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return syncDirectory(fpath)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(staging, jobdirectory); err != nil {
+		return err
+	}
+	return syncDirectory(filepath.Dir(jobdirectory))
+}
+
+//cleanStaging remove leftover staging directories and temp files under a job root.
+func cleanStaging(jobroot string) []string {
+
+	removed := []string{}
+	fis, err := ioutil.ReadDir(jobroot)
+	if err != nil {
+		return removed
+	}
+
+	for _, fic := range fis {
+		name := fic.Name()
+		if strings.HasPrefix(name, stagingPrefix) || strings.HasSuffix(name, tempSuffix) {
+			if err := os.RemoveAll(jobroot + "/" + name); err == nil {
+				removed = append(removed, jobroot+"/"+name)
+			}
+		}
+	}
+	return removed
+}
@@ -0,0 +1,17 @@
+package cache
+
+import (
+	"os"
+)
+
+//syncDirectory fsync directory entries, make renames durable.
+func syncDirectory(path string) error {
+
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer fd.Close()
+	return fd.Sync()
+}
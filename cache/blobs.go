@@ -0,0 +1,430 @@
+package cache
+
+import "github.com/cloudtask/libtools/gounits/logger"
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	//blob解压目录
+	blobTree = "tree"
+	//blob引用目录, 每个引用一个文件: <jobid>.<filecode>
+	blobRefs = "refs"
+	//blob文件清单, 记录解压内容的类型、大小与sha256, 用于校验job目录
+	blobManifest = "manifest.json"
+	//无引用blob的保留时长, 从发现无引用时开始计算
+	blobRetention = time.Hour
+	//blob无引用标记文件, 修改时间为首次发现无引用的时间
+	blobUnused = "unused"
+)
+
+//ErrBlobManifestMissing is exported
+var ErrBlobManifestMissing = errors.New("blob manifest missing")
+
+/*
+BlobStore is exported
+按文件包sha256摘要寻址的解压存储
+1、相同内容的文件包只解压一次: blobs/<sha256>/tree
+2、job工作目录通过硬链接引用blob文件(不支持硬链接时复制), blob文件只读
+3、每个引用job目录在blobs/<sha256>/refs下记录, 引用的job目录不存在后由DumpCleaner清理
+4、解压时生成blobs/<sha256>/manifest.json, 校验job目录内容
+*/
+type BlobStore struct {
+	Root   string
+	Limits *ExtractLimits
+	lock   func(name string) func() //blob锁, 由getter设置, 清理与解压、链接互斥
+}
+
+//blobEntry is a file of blob tree in manifest.
+type blobEntry struct {
+	Path   string      `json:"path"`
+	Mode   os.FileMode `json:"mode"`
+	Size   int64       `json:"size,omitempty"`
+	SHA256 string      `json:"sha256,omitempty"`
+	Link   string      `json:"link,omitempty"`
+}
+
+//NewBlobStore is exported
+func NewBlobStore(configs *CacheConfigs) *BlobStore {
+
+	return &BlobStore{
+		Root:   configs.SaveDirectory + "/blobs",
+		Limits: NewExtractLimits(configs.ExtractMaxBytes, configs.ExtractMaxEntries, configs.ExtractMaxDepth),
+	}
+}
+
+//Digest is exported
+//return jobfile sha256 digest hex.
+func (store *BlobStore) Digest(jobfile string) (string, error) {
+
+	digest, err := fileSHA256(jobfile)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(digest), nil
+}
+
+/*
+Extract is exported
+解压文件包到blob, 已存在直接复用. 调用方需保证同一digest不会并发解压.
+*/
+func (store *BlobStore) Extract(digest string, jobfile string) (string, error) {
+
+	blobroot := store.Root + "/" + digest
+	tree := blobroot + "/" + blobTree
+	if info, err := os.Stat(tree); err == nil && info.IsDir() {
+		return tree, nil
+	}
+
+	tempdir := blobroot + "/temp"
+	os.RemoveAll(tempdir)
+	if err := os.MkdirAll(tempdir, 0777); err != nil {
+		return "", err
+	}
+
+	if err := extractArchive(jobfile, tempdir, store.Limits); err != nil {
+		os.RemoveAll(blobroot)
+		return "", err
+	}
+
+	protectTree(tempdir)
+	if err := writeManifest(tempdir, blobroot+"/"+blobManifest); err != nil {
+		os.RemoveAll(blobroot)
+		return "", err
+	}
+
+	if err := activateDirectory(tempdir, tree); err != nil {
+		os.RemoveAll(blobroot)
+		return "", err
+	}
+	logger.INFO("[#cache#] blobs extract %s to %s", filepath.Base(jobfile), digest)
+	return tree, nil
+}
+
+/*
+Link is exported
+将blob内容链接到job工作目录, 并记录引用.
+*/
+func (store *BlobStore) Link(digest string, tree string, jobid string, filecode string, jobdirectory string) error {
+
+	refs := store.Root + "/" + digest + "/" + blobRefs
+	if err := os.MkdirAll(refs, 0777); err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(refs+"/"+jobid+"."+filecode, []byte(jobdirectory), 0666); err != nil {
+		return err
+	}
+
+	return filepath.Walk(tree, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(tree, fpath)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(jobdirectory, rel)
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, 0777)
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(fpath)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		default:
+			if err := os.Link(fpath, target); err == nil {
+				return nil
+			}
+			return copyFile(fpath, target, info.Mode())
+		}
+	})
+}
+
+/*
+Verify is exported
+按blob清单校验job目录中链接的文件: 类型一致, 普通文件大小与sha256一致, 符号链接目标一致.
+job目录中不在清单中的文件(如命令文件)不校验.
+*/
+func (store *BlobStore) Verify(digest string, jobdirectory string) error {
+
+	data, err := ioutil.ReadFile(store.Root + "/" + digest + "/" + blobManifest)
+	if os.IsNotExist(err) {
+		return ErrBlobManifestMissing
+	}
+
+	if err != nil {
+		return err
+	}
+
+	entries := []*blobEntry{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		target := filepath.Join(jobdirectory, entry.Path)
+		info, err := os.Lstat(target)
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeType != entry.Mode&os.ModeType {
+			return fmt.Errorf("%s type mismatch", entry.Path)
+		}
+		switch {
+		case entry.Mode&os.ModeSymlink != 0:
+			if link, err := os.Readlink(target); err != nil || link != entry.Link {
+				return fmt.Errorf("%s symlink target mismatch", entry.Path)
+			}
+		case entry.Mode.IsRegular():
+			if info.Size() != entry.Size {
+				return fmt.Errorf("%s size mismatch", entry.Path)
+			}
+			digest, err := fileSHA256(target)
+			if err != nil {
+				return err
+			}
+			if hex.EncodeToString(digest) != entry.SHA256 {
+				return fmt.Errorf("%s sha256 mismatch", entry.Path)
+			}
+		}
+	}
+	return nil
+}
+
+/*
+Referenced is exported
+返回被job目录(<jobid>.<filecode>)引用的blob摘要.
+*/
+func (store *BlobStore) Referenced(jobid string, filecode string) []string {
+
+	digests := []string{}
+	fis, err := ioutil.ReadDir(store.Root)
+	if err != nil {
+		return digests
+	}
+
+	for _, fic := range fis {
+		if !fic.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(store.Root + "/" + fic.Name() + "/" + blobRefs + "/" + jobid + "." + filecode); err == nil {
+			digests = append(digests, fic.Name())
+		}
+	}
+	return digests
+}
+
+/*
+Remove is exported
+删除blob, 已链接到其它job目录的文件不受影响(硬链接或复制的文件独立存在).
+*/
+func (store *BlobStore) Remove(digest string) error {
+
+	return os.RemoveAll(store.Root + "/" + digest)
+}
+
+/*
+CleanTemp is exported
+清理崩溃时遗留的解压临时目录与未完成解压的blob.
+*/
+func (store *BlobStore) CleanTemp() []string {
+
+	removed := []string{}
+	fis, err := ioutil.ReadDir(store.Root)
+	if err != nil {
+		return removed
+	}
+
+	for _, fic := range fis {
+		blobroot := store.Root + "/" + fic.Name()
+		if !fic.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(blobroot + "/temp"); err == nil {
+			os.RemoveAll(blobroot + "/temp")
+			removed = append(removed, blobroot+"/temp")
+		}
+		if _, err := os.Stat(blobroot + "/" + blobTree); os.IsNotExist(err) {
+			os.RemoveAll(blobroot)
+			removed = append(removed, blobroot)
+		}
+	}
+	return removed
+}
+
+/*
+Clean is exported
+清理引用的job目录已不存在的引用, 删除无引用且超过保留时长的blob.
+1、每个blob在blob锁内清理, 与解压、链接互斥, 正在解压(存在temp目录)的blob不清理
+2、保留时长从首次发现无引用时开始计算(unused标记文件), 重新被引用时删除标记
+3、retention为0时无引用的blob立即删除(配额回收)
+返回删除blob释放的字节数.
+*/
+func (store *BlobStore) Clean(root string, retention time.Duration) int64 {
+
+	fis, err := ioutil.ReadDir(store.Root)
+	if err != nil {
+		return 0
+	}
+
+	var freed int64
+	for _, fic := range fis {
+		if !fic.IsDir() {
+			continue
+		}
+		unlock := store.lockBlob(fic.Name())
+		freed += store.cleanBlob(root, fic.Name(), retention)
+		unlock()
+	}
+	return freed
+}
+
+//cleanBlob blob lock must be held, return freed bytes.
+func (store *BlobStore) cleanBlob(root string, digest string, retention time.Duration) int64 {
+
+	blobroot := store.Root + "/" + digest
+	if _, err := os.Stat(blobroot + "/temp"); err == nil { //正在解压
+		return 0
+	}
+
+	count := 0
+	refs, _ := ioutil.ReadDir(blobroot + "/" + blobRefs)
+	for _, ref := range refs {
+		names := strings.SplitN(ref.Name(), ".", 2)
+		if len(names) == 2 {
+			jobdirectory := root + "/" + names[0] + "/" + names[1]
+			if _, err := os.Stat(jobdirectory); err == nil {
+				count++
+				continue
+			}
+			if _, err := os.Stat(stagingDirectory(jobdirectory)); err == nil { //正在激活
+				count++
+				continue
+			}
+		}
+		os.Remove(blobroot + "/" + blobRefs + "/" + ref.Name())
+	}
+
+	unused := blobroot + "/" + blobUnused
+	if count > 0 {
+		os.Remove(unused)
+		return 0
+	}
+
+	if retention > 0 {
+		info, err := os.Stat(unused)
+		if os.IsNotExist(err) { //首次发现无引用, 开始计算保留时长
+			ioutil.WriteFile(unused, []byte{}, 0666)
+			return 0
+		}
+		if err != nil || time.Since(info.ModTime()) < retention {
+			return 0
+		}
+	}
+
+	size := reclaimableSize(blobroot)
+	if err := os.RemoveAll(blobroot); err != nil {
+		logger.ERROR("[#cache#] dumpcleaner remove blob %s error:%s", digest, err.Error())
+		return 0
+	}
+	logger.INFO("[#cache#] dumpcleaner remove blob %s", digest)
+	return size
+}
+
+//lockBlob lock a blob against extracting and linking.
+func (store *BlobStore) lockBlob(digest string) func() {
+
+	if store.lock == nil {
+		return func() {}
+	}
+	return store.lock(blobTree + "/" + digest)
+}
+
+//writeManifest record types, sizes and sha256 digests of tree files.
+func writeManifest(tree string, fpath string) error {
+
+	entries := []*blobEntry{}
+	err := filepath.Walk(tree, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(tree, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		entry := &blobEntry{Path: filepath.ToSlash(rel), Mode: info.Mode()}
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			if entry.Link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			digest, err := fileSHA256(path)
+			if err != nil {
+				return err
+			}
+			entry.Size = info.Size()
+			entry.SHA256 = hex.EncodeToString(digest)
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fpath, data, 0666)
+}
+
+//protectTree set blob files read-only, jobs can not modify shared files in place.
+func protectTree(tree string) {
+
+	filepath.Walk(tree, func(fpath string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			os.Chmod(fpath, readonlyMode(info.Mode()))
+		}
+		return nil
+	})
+}
+
+func copyFile(src string, dst string, mode os.FileMode) error {
+
+	sfd, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+
+	defer sfd.Close()
+	dfd, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm()|0200)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(dfd, sfd); err == nil {
+		err = dfd.Sync()
+	}
+
+	if err != nil {
+		dfd.Close()
+		return err
+	}
+	return dfd.Close()
+}
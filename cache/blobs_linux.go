@@ -0,0 +1,11 @@
+package cache
+
+import (
+	"os"
+)
+
+//readonlyMode clear write permission bits.
+func readonlyMode(mode os.FileMode) os.FileMode {
+
+	return mode.Perm() &^ 0222
+}
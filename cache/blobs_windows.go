@@ -0,0 +1,11 @@
+package cache
+
+import (
+	"os"
+)
+
+//readonlyMode keep mode, read-only files can not be removed from hardlinked workdir on windows.
+func readonlyMode(mode os.FileMode) os.FileMode {
+
+	return mode.Perm()
+}
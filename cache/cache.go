@@ -2,15 +2,33 @@ package cache
 
 import "github.com/cloudtask/common/models"
 
+import (
+	"os"
+)
+
 //CacheConfigs is exported
 type CacheConfigs struct {
-	CenterHost    string
-	WebsiteHost   string
-	MaxJobs       int
-	SaveDirectory string
-	AutoClean     bool
-	CleanInterval string
-	PullRecovery  string
+	CenterHost        string
+	WebsiteHost       string
+	MaxJobs           int
+	SaveDirectory     string
+	AutoClean         bool
+	CleanInterval     string
+	PullRecovery      string
+	PullParallel      int
+	PullTimeout       string
+	TrustedKeys       []string
+	PeerShare         bool
+	PeerToken         string
+	ExtractMaxBytes   int64
+	ExtractMaxEntries int
+	ExtractMaxDepth   int
+	MaxSize           int64
+	MinFree           int64
+	JobRetention      string
+	OfflineMode       bool
+	AllocNode         bool
+	Sources           []*SourceConfigs
 }
 
 //Cache is exported
@@ -22,11 +40,13 @@ type Cache struct {
 //NewCache is exported
 func NewCache(configs *CacheConfigs, handler ICacheHandler) *Cache {
 
+	allocTracker := NewAllocTracker(configs.SaveDirectory)
+	jobStore := NewJobStore(configs, allocTracker,
+		handler.OnJobCacheChangedHandlerFunc,
+		handler.OnJobCacheExceptionHandlerFunc)
 	return &Cache{
-		dumpCleaner: NewDumpCleaner(configs),
-		jobStore: NewJobStore(configs,
-			handler.OnJobCacheChangedHandlerFunc,
-			handler.OnJobCacheExceptionHandlerFunc),
+		dumpCleaner: NewDumpCleaner(configs, jobStore.getter.blobs, allocTracker, handler.OnJobCacheChangedHandlerFunc), //与getter共用blob锁
+		jobStore:    jobStore,
 	}
 }
 
@@ -36,6 +56,33 @@ func (cache *Cache) SetServerConfigsParameter(centerHost string, websiteHost str
 	cache.jobStore.SetServerConfigsParameter(centerHost, websiteHost)
 }
 
+//SetPeers is exported
+//set agents api address of the same runtime, jobfiles are pulled from peers first.
+func (cache *Cache) SetPeers(peers []string) {
+
+	cache.jobStore.SetPeers(peers)
+}
+
+//OpenJobFile is exported
+//open a cached jobfile to share with peers.
+func (cache *Cache) OpenJobFile(filename string) (*os.File, error) {
+
+	return cache.jobStore.OpenJobFile(filename)
+}
+
+//PinJobDirectory is exported
+//keep job running directory from dumpcleaner until unpin.
+func (cache *Cache) PinJobDirectory(jobid string, filecode string) {
+
+	cache.dumpCleaner.Pin(jobid, filecode)
+}
+
+//UnpinJobDirectory is exported
+func (cache *Cache) UnpinJobDirectory(jobid string) {
+
+	cache.dumpCleaner.Unpin(jobid)
+}
+
 //StartDumpCleaner is exported
 func (cache *Cache) StartDumpCleaner() {
 
@@ -79,6 +126,13 @@ func (cache *Cache) SetAllocBuffer(key string, data []byte) (int, error) {
 	return version, nil
 }
 
+//RestoreAlloc is exported
+//restore the last applied jobs alloc from local, used when cluster is unreachable
+func (cache *Cache) RestoreAlloc(key string) (int, error) {
+
+	return cache.jobStore.RestoreAlloc(key)
+}
+
 //GetAllocVersion is exported
 //return jobsalloc version
 func (cache *Cache) GetAllocVersion() int {
@@ -86,6 +140,13 @@ func (cache *Cache) GetAllocVersion() int {
 	return cache.jobStore.GetAllocVersion()
 }
 
+//GetLoad is exported
+//return activated jobs count, rejected jobs count and max jobs
+func (cache *Cache) GetLoad() (int, int, int) {
+
+	return cache.jobStore.GetLoad()
+}
+
 //GetJobsCount is exported
 //return jobsalloc job count
 func (cache *Cache) GetJobsCount() int {
@@ -106,3 +167,45 @@ func (cache *Cache) GetJob(jobid string) *models.JobBase {
 
 	return cache.jobStore.GetJob(jobid)
 }
+
+//GetStatus is exported
+//return cache & getter state
+func (cache *Cache) GetStatus() *CacheStatus {
+
+	return cache.jobStore.GetStatus()
+}
+
+//GetSources is exported
+//return package sources and their health
+func (cache *Cache) GetSources() []*SourceStatus {
+
+	return cache.jobStore.GetSources()
+}
+
+//GetJobStatus is exported
+//return a allocated job cache & getter state
+func (cache *Cache) GetJobStatus(jobid string) *JobStatus {
+
+	return cache.jobStore.GetJobStatus(jobid)
+}
+
+//RepullJob is exported
+//invalidate a job local files and pull it immediately, the job is held off dispatching by pinner until pulled
+func (cache *Cache) RepullJob(jobid string, pinner JobPinner) error {
+
+	return cache.jobStore.RepullJob(jobid, pinner)
+}
+
+//VerifyJobs is exported
+//verify all allocated jobs cache content and repull failed jobs
+func (cache *Cache) VerifyJobs(pinner JobPinner) []*VerifyResult {
+
+	return cache.jobStore.VerifyJobs(pinner)
+}
+
+//GetDownloads is exported
+//return pulling jobfiles progress and retry state
+func (cache *Cache) GetDownloads() []*DownloadProgress {
+
+	return cache.jobStore.GetDownloads()
+}
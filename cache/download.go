@@ -0,0 +1,262 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//下载未完成的临时文件后缀
+	partSuffix = ".part"
+	//未下载完成文件的保留时长, 超过后由dumpcleaner清理
+	partRetention = 24 * time.Hour
+	//失败重试初始间隔
+	retryBaseInterval = 5 * time.Second
+	//恢复拉取检查间隔
+	retryTickInterval = 1 * time.Second
+)
+
+/*
+DownloadProgress is exported
+Job文件包下载进度
+*/
+type DownloadProgress struct {
+	JobId      string    `json:"jobid"`
+	FileName   string    `json:"filename"`
+	Downloaded int64     `json:"downloaded"` //已下载字节数(包含续传前已下载部分)
+	Total      int64     `json:"total"`      //文件总字节数, 未知为-1
+	Attempts   int       `json:"attempts"`   //连续失败次数
+	NextRetry  time.Time `json:"nextretry"`  //下次重试时间
+	Error      string    `json:"error"`      //最近一次失败原因
+	UpdateAt   time.Time `json:"updateat"`
+}
+
+/*
+downloadTracker 下载进度集合
+使用独立的锁, 下载时持有getter锁也可以查询进度.
+*/
+type downloadTracker struct {
+	sync.RWMutex
+	progress map[string]*DownloadProgress
+}
+
+func newDownloadTracker() *downloadTracker {
+
+	return &downloadTracker{
+		progress: make(map[string]*DownloadProgress),
+	}
+}
+
+func (tracker *downloadTracker) update(jobid string, fn func(progress *DownloadProgress)) {
+
+	tracker.Lock()
+	progress, ret := tracker.progress[jobid]
+	if !ret {
+		progress = &DownloadProgress{JobId: jobid, Total: -1}
+		tracker.progress[jobid] = progress
+	}
+	fn(progress)
+	progress.UpdateAt = time.Now()
+	tracker.Unlock()
+}
+
+func (tracker *downloadTracker) set(jobid string, filename string, downloaded int64, total int64) {
+
+	tracker.update(jobid, func(progress *DownloadProgress) {
+		progress.FileName = filename
+		progress.Downloaded = downloaded
+		progress.Total = total
+	})
+}
+
+func (tracker *downloadTracker) retry(jobid string, attempts int, next time.Time, err string) {
+
+	tracker.update(jobid, func(progress *DownloadProgress) {
+		progress.Attempts = attempts
+		progress.NextRetry = next
+		progress.Error = err
+	})
+}
+
+func (tracker *downloadTracker) remove(jobid string) {
+
+	tracker.Lock()
+	delete(tracker.progress, jobid)
+	tracker.Unlock()
+}
+
+func (tracker *downloadTracker) list() []*DownloadProgress {
+
+	tracker.RLock()
+	defer tracker.RUnlock()
+	progress := []*DownloadProgress{}
+	for _, value := range tracker.progress {
+		item := *value
+		progress = append(progress, &item)
+	}
+	return progress
+}
+
+//progressWriter count written bytes and update download progress.
+type progressWriter struct {
+	tracker    *downloadTracker
+	jobid      string
+	filename   string
+	downloaded int64
+	total      int64
+	reportAt   time.Time
+}
+
+func (writer *progressWriter) Write(p []byte) (int, error) {
+
+	writer.downloaded += int64(len(p))
+	if time.Since(writer.reportAt) >= time.Second {
+		writer.reportAt = time.Now()
+		writer.tracker.set(writer.jobid, writer.filename, writer.downloaded, writer.total)
+	}
+	return len(p), nil
+}
+
+/*
+downloadFile 断点续传下载
+文件先写入jobfile.part, 已存在part文件时通过Range请求续传,
+下载完整后fsync并rename为jobfile, 失败时保留part文件等待下次续传.
+sign不为nil时在发送前签名请求(如S3源).
+*/
+func (getter *JobGetter) downloadFile(ctx context.Context, jobid string, jobfile string, remoteurl string, sign func(*http.Request)) error {
+
+	partfile := jobfile + partSuffix
+	var offset int64
+	if fi, err := os.Stat(partfile); err == nil {
+		offset = fi.Size()
+	}
+
+	req, err := http.NewRequest(http.MethodGet, remoteurl, nil)
+	if err != nil {
+		return err
+	}
+
+	req = req.WithContext(ctx)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	if sign != nil {
+		sign(req)
+	}
+
+	resp, err := getter.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	flags := os.O_CREATE | os.O_WRONLY
+	var total int64 = -1
+	switch resp.StatusCode {
+	case http.StatusPartialContent: //续传
+		if start, size, ret := parseContentRange(resp.Header.Get("Content-Range")); !ret || start != offset {
+			os.Remove(partfile)
+			return fmt.Errorf("http content-range invalid %s", resp.Header.Get("Content-Range"))
+		} else {
+			total = size
+		}
+		flags |= os.O_APPEND
+	case http.StatusOK: //不支持Range, 重新下载
+		offset = 0
+		flags |= os.O_TRUNC
+		if resp.ContentLength >= 0 {
+			total = resp.ContentLength
+		}
+	case http.StatusRequestedRangeNotSatisfiable: //part文件已无效, 下次重新下载
+		os.Remove(partfile)
+		return fmt.Errorf("http code:%d", resp.StatusCode)
+	case http.StatusNotFound:
+		return ErrSourceNotFound
+	default:
+		return fmt.Errorf("http code:%d", resp.StatusCode)
+	}
+
+	fd, err := os.OpenFile(partfile, flags, 0777)
+	if err != nil {
+		return err
+	}
+
+	writer := &progressWriter{tracker: getter.downloads, jobid: jobid, filename: jobfile, downloaded: offset, total: total}
+	getter.downloads.set(jobid, jobfile, offset, total)
+	_, err = io.Copy(fd, io.TeeReader(resp.Body, writer))
+	getter.downloads.set(jobid, jobfile, writer.downloaded, total)
+	if err == nil {
+		err = fd.Sync()
+	}
+	fd.Close()
+	if err != nil {
+		return err
+	}
+
+	if total >= 0 && writer.downloaded != total {
+		return fmt.Errorf("download incomplete %d/%d", writer.downloaded, total)
+	}
+
+	return os.Rename(partfile, jobfile)
+}
+
+//parseContentRange parse "bytes start-end/size", size unknown(*) return -1.
+func parseContentRange(value string) (int64, int64, bool) {
+
+	value = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(value), "bytes"))
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+
+	ranges := strings.SplitN(parts[0], "-", 2)
+	start, err := strconv.ParseInt(strings.TrimSpace(ranges[0]), 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	if parts[1] == "*" {
+		return start, -1, true
+	}
+
+	size, err := strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return start, size, true
+}
+
+/*
+retryBackoff 指数退避
+第n次失败后等待 base*2^(n-1), 最大不超过max, 并加入随机抖动避免所有job同时重试.
+*/
+func retryBackoff(attempts int, max time.Duration) time.Duration {
+
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	if attempts > 16 {
+		attempts = 16
+	}
+
+	backoff := retryBaseInterval << uint(attempts-1)
+	if backoff > max {
+		backoff = max
+	}
+
+	half := int64(backoff / 2)
+	if half <= 0 {
+		return backoff
+	}
+	return time.Duration(half + rand.Int63n(half+1))
+}
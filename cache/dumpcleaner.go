@@ -10,30 +10,48 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 )
 
 //DumpCleaner is exported
 type DumpCleaner struct {
-	Root     string
-	Enabled  bool
-	Duration time.Duration
-	stopCh   chan struct{}
+	sync.Mutex
+	Root      string
+	Enabled   bool
+	Duration  time.Duration
+	Retention time.Duration
+	blobs     *BlobStore
+	tracker   *AllocTracker
+	callback  JobCacheChangedHandlerFunc
+	pins      map[string]string //正在执行的job目录(jobid:filecode), 清理时保留
+	stopCh    chan struct{}
 }
 
 //NewDumpCleaner is exported
-func NewDumpCleaner(configs *CacheConfigs) *DumpCleaner {
+func NewDumpCleaner(configs *CacheConfigs, blobs *BlobStore, tracker *AllocTracker, callback JobCacheChangedHandlerFunc) *DumpCleaner {
 
 	duration, err := time.ParseDuration(configs.CleanInterval)
 	if err != nil {
 		duration, _ = time.ParseDuration("30m")
 	}
 
+	retention, err := time.ParseDuration(configs.JobRetention)
+	if err != nil {
+		retention, _ = time.ParseDuration("24h")
+	}
+
 	return &DumpCleaner{
-		Root:     configs.SaveDirectory,
-		Enabled:  configs.AutoClean,
-		Duration: duration,
-		stopCh:   nil,
+		Root:      configs.SaveDirectory,
+		Enabled:   configs.AutoClean,
+		Duration:  duration,
+		Retention: retention,
+		blobs:     blobs,
+		tracker:   tracker,
+		callback:  callback,
+		pins:      make(map[string]string),
+		stopCh:    nil,
 	}
 }
 
@@ -61,6 +79,32 @@ func (dumpCleaner *DumpCleaner) Stop() {
 	}
 }
 
+/*
+Pin is exported
+保留job正在执行的目录, 新版本切换前旧版本目录不会被清理.
+*/
+func (dumpCleaner *DumpCleaner) Pin(jobid string, filecode string) {
+
+	dumpCleaner.Lock()
+	dumpCleaner.pins[jobid] = filecode
+	dumpCleaner.Unlock()
+}
+
+//Unpin is exported
+func (dumpCleaner *DumpCleaner) Unpin(jobid string) {
+
+	dumpCleaner.Lock()
+	delete(dumpCleaner.pins, jobid)
+	dumpCleaner.Unlock()
+}
+
+func (dumpCleaner *DumpCleaner) pinned(jobid string) string {
+
+	dumpCleaner.Lock()
+	defer dumpCleaner.Unlock()
+	return dumpCleaner.pins[jobid]
+}
+
 func (dumpCleaner *DumpCleaner) checkLoop() {
 
 	for {
@@ -69,15 +113,17 @@ func (dumpCleaner *DumpCleaner) checkLoop() {
 		case <-runTicker.C:
 			{
 				runTicker.Stop()
+				dumpCleaner.tracker.Purge(dumpCleaner.Root, dumpCleaner.Retention, dumpCleaner.callback)
 				jobs := readJobs(dumpCleaner.Root)
 				jobfiles := []string{}
 				for _, jobbase := range jobs {
-					removeJobDirectories(dumpCleaner.Root, jobbase)
+					removeJobDirectories(dumpCleaner.Root, jobbase, dumpCleaner.pinned(jobbase.JobId))
 					if jobbase.FileName != "" {
 						jobfiles = append(jobfiles, jobbase.FileName)
 					}
 				}
 				removeJobFiles(dumpCleaner.Root, jobfiles)
+				dumpCleaner.blobs.Clean(dumpCleaner.Root, blobRetention)
 			}
 		case <-dumpCleaner.stopCh:
 			{
@@ -112,7 +158,7 @@ func readJobs(root string) []*models.JobBase {
 	return jobs
 }
 
-func removeJobDirectories(root string, jobbase *models.JobBase) {
+func removeJobDirectories(root string, jobbase *models.JobBase, pinned string) {
 
 	jobroot, err := filepath.Abs(root + "/" + jobbase.JobId)
 	if err != nil {
@@ -126,7 +172,7 @@ func removeJobDirectories(root string, jobbase *models.JobBase) {
 
 	for _, fic := range fis {
 		jobdirectory := fic.Name()
-		if fic.IsDir() && jobbase.FileCode != jobdirectory {
+		if fic.IsDir() && jobbase.FileCode != jobdirectory && pinned != jobdirectory && !strings.HasPrefix(jobdirectory, stagingPrefix) {
 			if err := os.RemoveAll(jobroot + "/" + jobdirectory); err != nil {
 				logger.ERROR("[#cache#] dumpcleaner remove %s error:%s", jobdirectory, err.Error())
 			} else {
@@ -150,6 +196,9 @@ func removeJobFiles(root string, jobfiles []string) {
 
 	for _, fic := range fis {
 		jobfile := fic.Name()
+		if strings.HasSuffix(jobfile, partSuffix) && time.Since(fic.ModTime()) < partRetention {
+			continue //保留近期未下载完成的文件用于断点续传
+		}
 		if !fic.IsDir() && !utils.Contains(jobfile, jobfiles) {
 			if err := os.Remove(filesroot + "/" + jobfile); err != nil {
 				logger.ERROR("[#cache#] dumpcleaner remove %s error:%s", jobfile, err.Error())
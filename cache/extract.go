@@ -0,0 +1,296 @@
+package cache
+
+import "github.com/cloudtask/libtools/gounits/logger"
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	//默认解压总字节数上限 1GB
+	DEFAULT_EXTRACT_MAXBYTES = 1073741824
+	//默认解压文件数上限
+	DEFAULT_EXTRACT_MAXENTRIES = 100000
+	//默认解压目录深度上限
+	DEFAULT_EXTRACT_MAXDEPTH = 32
+)
+
+/*
+ExtractLimits is exported
+文件包解压限制, <=0使用默认值
+*/
+type ExtractLimits struct {
+	MaxBytes   int64
+	MaxEntries int
+	MaxDepth   int
+}
+
+//NewExtractLimits is exported
+func NewExtractLimits(maxBytes int64, maxEntries int, maxDepth int) *ExtractLimits {
+
+	if maxBytes <= 0 {
+		maxBytes = DEFAULT_EXTRACT_MAXBYTES
+	}
+
+	if maxEntries <= 0 {
+		maxEntries = DEFAULT_EXTRACT_MAXENTRIES
+	}
+
+	if maxDepth <= 0 {
+		maxDepth = DEFAULT_EXTRACT_MAXDEPTH
+	}
+
+	return &ExtractLimits{
+		MaxBytes:   maxBytes,
+		MaxEntries: maxEntries,
+		MaxDepth:   maxDepth,
+	}
+}
+
+/*
+UnsafeArchiveError is exported
+文件包条目越界(绝对路径、../、指向目录外的链接)或超过解压限制
+*/
+type UnsafeArchiveError struct {
+	Entry  string
+	Reason string
+}
+
+func (err *UnsafeArchiveError) Error() string {
+
+	return fmt.Sprintf("unsafe archive entry %q, %s", err.Entry, err.Reason)
+}
+
+/*
+extractArchive 安全解压文件包到root, 按文件头识别格式(见extractors.go)
+1、每个条目的路径与链接目标必须位于root内, 不允许经由已解压的符号链接写入
+2、限制解压总字节数、条目数与目录深度
+3、设备文件等特殊条目忽略
+*/
+func extractArchive(archive string, root string, limits *ExtractLimits) error {
+
+	fd, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+
+	defer fd.Close()
+	header, err := readHeader(fd)
+	if err != nil {
+		return err
+	}
+
+	extractor, err := detectExtractor(header)
+	if err != nil {
+		return err
+	}
+	logger.INFO("[#cache#] extract %s as %s", filepath.Base(archive), extractor.Name())
+	return extractor.Extract(fd, root, limits)
+}
+
+func extractTar(reader *tar.Reader, root string, limits *ExtractLimits) error {
+
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	entries := 0
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return checkSymlinks(root)
+		}
+		if err != nil {
+			return err
+		}
+
+		entries++
+		if entries > limits.MaxEntries {
+			return &UnsafeArchiveError{Entry: header.Name, Reason: fmt.Sprintf("entries exceed limit %d", limits.MaxEntries)}
+		}
+
+		target, rel, err := resolveEntry(root, header.Name, limits)
+		if err != nil {
+			return err
+		}
+
+		if rel == "." {
+			continue
+		}
+
+		if err := checkParents(root, rel, header.Name); err != nil {
+			return err
+		}
+
+		mode := header.FileInfo().Mode()
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, mode.Perm()|0700); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if total+header.Size > limits.MaxBytes {
+				return &UnsafeArchiveError{Entry: header.Name, Reason: fmt.Sprintf("total size exceed limit %d", limits.MaxBytes)}
+			}
+			written, err := writeEntry(target, reader, mode, limits.MaxBytes-total)
+			total += written
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := checkLink(root, target, header.Linkname, header.Name, true); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0777); err != nil {
+				return err
+			}
+			os.Remove(target)
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			if err := checkLink(root, target, header.Linkname, header.Name, false); err != nil {
+				return err
+			}
+			source, srcrel, err := resolveEntry(root, header.Linkname, limits)
+			if err != nil {
+				return err
+			}
+			if err := checkParents(root, srcrel, header.Name); err != nil {
+				return err
+			}
+			if info, err := os.Lstat(source); err != nil || !info.Mode().IsRegular() {
+				return &UnsafeArchiveError{Entry: header.Name, Reason: "hard link target is not an extracted regular file"}
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0777); err != nil {
+				return err
+			}
+			os.Remove(target)
+			if err := os.Link(source, target); err != nil {
+				return err
+			}
+		case tar.TypeXGlobalHeader, tar.TypeXHeader:
+		default:
+			logger.WARN("[#cache#] extract ignore entry %s type %c", header.Name, header.Typeflag)
+		}
+	}
+}
+
+//resolveEntry return entry absolute target and relative path, the target must be under root.
+func resolveEntry(root string, name string, limits *ExtractLimits) (string, string, error) {
+
+	name = strings.Replace(name, "\\", "/", -1)
+	if strings.HasPrefix(name, "/") || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", "", &UnsafeArchiveError{Entry: name, Reason: "absolute path"}
+	}
+
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", "", &UnsafeArchiveError{Entry: name, Reason: "path traversal"}
+		}
+	}
+
+	rel := filepath.Clean(filepath.FromSlash(name))
+	if rel != "." && len(strings.Split(filepath.ToSlash(rel), "/")) > limits.MaxDepth {
+		return "", "", &UnsafeArchiveError{Entry: name, Reason: fmt.Sprintf("depth exceed limit %d", limits.MaxDepth)}
+	}
+	return filepath.Join(root, rel), rel, nil
+}
+
+//checkParents refuse writing an entry through a symlink created by earlier entries.
+func checkParents(root string, rel string, name string) error {
+
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	current := root
+	for _, part := range parts[:len(parts)-1] {
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if err != nil {
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return &UnsafeArchiveError{Entry: name, Reason: "parent is a symlink"}
+		}
+	}
+	return nil
+}
+
+//checkLink link target must be relative and resolve under root.
+func checkLink(root string, target string, linkname string, name string, symlink bool) error {
+
+	linkname = strings.Replace(linkname, "\\", "/", -1)
+	if linkname == "" || strings.HasPrefix(linkname, "/") || filepath.IsAbs(linkname) || filepath.VolumeName(linkname) != "" {
+		return &UnsafeArchiveError{Entry: name, Reason: "link to absolute path " + linkname}
+	}
+
+	resolved := filepath.Join(root, filepath.FromSlash(linkname))
+	if symlink { //符号链接相对于链接所在目录
+		resolved = filepath.Join(filepath.Dir(target), filepath.FromSlash(linkname))
+	}
+
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return &UnsafeArchiveError{Entry: name, Reason: "link outside root " + linkname}
+	}
+	return nil
+}
+
+//checkSymlinks make sure all extracted symlinks finally resolve under root.
+func checkSymlinks(root string) error {
+
+	realroot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+
+	return filepath.Walk(root, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			return err
+		}
+		resolved, err := filepath.EvalSymlinks(fpath)
+		if err != nil { //悬空链接, 创建时已按路径校验
+			return nil
+		}
+		rel, err := filepath.Rel(realroot, resolved)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			rel, _ = filepath.Rel(root, fpath)
+			return &UnsafeArchiveError{Entry: filepath.ToSlash(rel), Reason: "symlink resolves outside root"}
+		}
+		return nil
+	})
+}
+
+//writeEntry write a regular file, remain is the bytes left before exceeding limit.
+func writeEntry(target string, reader io.Reader, mode os.FileMode, remain int64) (int64, error) {
+
+	if err := os.MkdirAll(filepath.Dir(target), 0777); err != nil {
+		return 0, err
+	}
+
+	os.Remove(target)
+	fd, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm()|0600)
+	if err != nil {
+		return 0, err
+	}
+
+	written, err := io.Copy(fd, io.LimitReader(reader, remain+1))
+	if err == nil {
+		err = fd.Sync()
+	}
+	fd.Close()
+	if err != nil {
+		return written, err
+	}
+
+	if written > remain {
+		return written, &UnsafeArchiveError{Entry: filepath.Base(target), Reason: "total size exceed limit"}
+	}
+	return written, nil
+}
@@ -0,0 +1,234 @@
+package cache
+
+import "github.com/klauspost/compress/zstd"
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	testEntryFile     = "file"
+	testEntryDir      = "dir"
+	testEntrySymlink  = "symlink"
+	testEntryHardlink = "hardlink"
+)
+
+type testEntry struct {
+	kind string
+	name string
+	body string
+	link string
+}
+
+func writeTestTar(w io.Writer, entries []testEntry) error {
+
+	tw := tar.NewWriter(w)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Mode: 0644, Linkname: entry.link}
+		switch entry.kind {
+		case testEntryFile:
+			header.Typeflag, header.Size = tar.TypeReg, int64(len(entry.body))
+		case testEntryDir:
+			header.Typeflag, header.Mode = tar.TypeDir, 0755
+		case testEntrySymlink:
+			header.Typeflag, header.Mode = tar.TypeSymlink, 0777
+		case testEntryHardlink:
+			header.Typeflag = tar.TypeLink
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := tw.Write([]byte(entry.body)); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+//newTestArchive write entries to an archive of format, zip has no hard links.
+func newTestArchive(t *testing.T, format string, entries []testEntry) string {
+
+	buf := &bytes.Buffer{}
+	var err error
+	switch format {
+	case "tar":
+		err = writeTestTar(buf, entries)
+	case "tar.gz":
+		gz := gzip.NewWriter(buf)
+		if err = writeTestTar(gz, entries); err == nil {
+			err = gz.Close()
+		}
+	case "tar.zst":
+		var zw *zstd.Encoder
+		if zw, err = zstd.NewWriter(buf); err == nil {
+			if err = writeTestTar(zw, entries); err == nil {
+				err = zw.Close()
+			}
+		}
+	case "zip":
+		zw := zip.NewWriter(buf)
+		for _, entry := range entries {
+			header := &zip.FileHeader{Name: entry.name, Method: zip.Deflate}
+			body := entry.body
+			switch entry.kind {
+			case testEntryDir:
+				header.Name = strings.TrimSuffix(entry.name, "/") + "/"
+				header.SetMode(os.ModeDir | 0755)
+			case testEntrySymlink:
+				header.SetMode(os.ModeSymlink | 0777)
+				body = entry.link
+			default:
+				header.SetMode(0644)
+			}
+			fw, err := zw.CreateHeader(header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fw.Write([]byte(body))
+		}
+		err = zw.Close()
+	}
+	if err != nil {
+		t.Fatalf("create %s archive error, %s", format, err)
+	}
+
+	archive := filepath.Join(t.TempDir(), "job."+format)
+	if err := ioutil.WriteFile(archive, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return archive
+}
+
+func TestExtractArchive(t *testing.T) {
+
+	limits := NewExtractLimits(1024, 8, 4)
+	testCases := []struct {
+		name     string
+		entries  []testEntry
+		unsafe   bool
+		tarOnly  bool
+		expected map[string]string //解压成功后的文件内容
+	}{
+		{
+			name: "safe",
+			entries: []testEntry{
+				{kind: testEntryDir, name: "bin"},
+				{kind: testEntryFile, name: "bin/run.sh", body: "#!/bin/sh\n"},
+				{kind: testEntrySymlink, name: "run", link: "bin/run.sh"},
+				{kind: testEntrySymlink, name: "bin/self", link: "../run"},
+			},
+			expected: map[string]string{"bin/run.sh": "#!/bin/sh\n", "run": "#!/bin/sh\n", "bin/self": "#!/bin/sh\n"},
+		},
+		{
+			name: "hard link",
+			entries: []testEntry{
+				{kind: testEntryFile, name: "a", body: "data"},
+				{kind: testEntryHardlink, name: "b", link: "a"},
+			},
+			tarOnly:  true,
+			expected: map[string]string{"a": "data", "b": "data"},
+		},
+		{name: "absolute path", entries: []testEntry{{kind: testEntryFile, name: "/tmp/outside", body: "x"}}, unsafe: true},
+		{name: "path traversal", entries: []testEntry{{kind: testEntryFile, name: "../outside", body: "x"}}, unsafe: true},
+		{name: "nested traversal", entries: []testEntry{{kind: testEntryFile, name: "a/../../outside", body: "x"}}, unsafe: true},
+		{name: "backslash traversal", entries: []testEntry{{kind: testEntryFile, name: "..\\outside", body: "x"}}, unsafe: true},
+		{name: "symlink escape", entries: []testEntry{{kind: testEntrySymlink, name: "link", link: "../outside"}}, unsafe: true},
+		{name: "symlink absolute", entries: []testEntry{{kind: testEntrySymlink, name: "link", link: "/etc/passwd"}}, unsafe: true},
+		{
+			name: "symlink chain escape",
+			entries: []testEntry{
+				{kind: testEntrySymlink, name: "a/up", link: ".."},
+				{kind: testEntrySymlink, name: "b", link: "a/up/.."},
+			},
+			unsafe: true,
+		},
+		{
+			name: "write through symlink",
+			entries: []testEntry{
+				{kind: testEntryDir, name: "real"},
+				{kind: testEntrySymlink, name: "link", link: "real"},
+				{kind: testEntryFile, name: "link/file", body: "x"},
+			},
+			unsafe: true,
+		},
+		{
+			name: "hard link escape",
+			entries: []testEntry{
+				{kind: testEntryHardlink, name: "passwd", link: "../../../../etc/passwd"},
+			},
+			unsafe:  true,
+			tarOnly: true,
+		},
+		{name: "file size limit", entries: []testEntry{{kind: testEntryFile, name: "big", body: strings.Repeat("x", 1025)}}, unsafe: true},
+		{
+			name: "total size limit",
+			entries: []testEntry{
+				{kind: testEntryFile, name: "a", body: strings.Repeat("x", 600)},
+				{kind: testEntryFile, name: "b", body: strings.Repeat("x", 600)},
+			},
+			unsafe: true,
+		},
+		{
+			name: "entry limit",
+			entries: func() []testEntry {
+				entries := []testEntry{}
+				for _, name := range strings.Split("a b c d e f g h i", " ") {
+					entries = append(entries, testEntry{kind: testEntryFile, name: name, body: name})
+				}
+				return entries
+			}(),
+			unsafe: true,
+		},
+		{name: "depth limit", entries: []testEntry{{kind: testEntryFile, name: "a/b/c/d/e", body: "x"}}, unsafe: true},
+	}
+
+	for _, format := range []string{"tar", "tar.gz", "tar.zst", "zip"} {
+		for _, testCase := range testCases {
+			if testCase.tarOnly && format == "zip" {
+				continue
+			}
+			t.Run(format+"/"+testCase.name, func(t *testing.T) {
+				archive := newTestArchive(t, format, testCase.entries)
+				parent := t.TempDir()
+				root := filepath.Join(parent, "root")
+				os.MkdirAll(root, 0755)
+				err := extractArchive(archive, root, limits)
+				if testCase.unsafe {
+					if _, ret := err.(*UnsafeArchiveError); !ret {
+						t.Fatalf("extract error %v, want UnsafeArchiveError", err)
+					}
+					if _, err := os.Lstat(filepath.Join(parent, "outside")); err == nil {
+						t.Fatalf("entry written outside root")
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("extract error %s", err)
+				}
+				for name, body := range testCase.expected {
+					if data, err := ioutil.ReadFile(filepath.Join(root, name)); err != nil || string(data) != body {
+						t.Fatalf("%s content %q, %v, want %q", name, data, err, body)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestExtractArchiveUnknown(t *testing.T) {
+
+	archive := filepath.Join(t.TempDir(), "job.tar")
+	ioutil.WriteFile(archive, []byte("not an archive"), 0644)
+	if err := extractArchive(archive, t.TempDir(), NewExtractLimits(0, 0, 0)); err != ErrArchiveUnknown {
+		t.Fatalf("extract error %v, want %v", err, ErrArchiveUnknown)
+	}
+}
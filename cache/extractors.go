@@ -0,0 +1,320 @@
+package cache
+
+import "github.com/cloudtask/libtools/gounits/logger"
+import "github.com/klauspost/compress/zstd"
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	//格式识别读取的文件头长度, 覆盖tar头部(512字节)
+	magicSize = 512
+	//zstd解压窗口内存上限
+	zstdMaxMemory = 256 << 20
+	//zip符号链接目标最大长度
+	zipMaxLinkname = 4096
+	//unix创建的zip, 外部属性中携带文件权限
+	zipCreatorUnix = 3
+)
+
+//ErrArchiveUnknown is exported
+var ErrArchiveUnknown = errors.New("archive format unknown")
+
+/*
+Extractor is exported
+文件包解压器, 按文件头(magic bytes)识别格式, 与文件扩展名无关.
+Extract必须保证条目位于root内并遵守解压限制, 越界返回UnsafeArchiveError.
+*/
+type Extractor interface {
+	Name() string
+	Detect(header []byte) bool
+	Extract(archive *os.File, root string, limits *ExtractLimits) error
+}
+
+/*
+extractorRegistry 已注册的解压器, 按注册顺序识别
+内置: zip, tar.gz, tar.zst, tar
+*/
+var extractorRegistry = struct {
+	sync.RWMutex
+	extractors []Extractor
+}{
+	extractors: []Extractor{
+		&zipExtractor{},
+		&tarGzipExtractor{},
+		&tarZstdExtractor{},
+		&tarExtractor{},
+	},
+}
+
+//RegisterExtractor is exported
+//register an extractor, the same name replace the exists one, new extractor detect before builtin ones.
+func RegisterExtractor(extractor Extractor) {
+
+	extractorRegistry.Lock()
+	defer extractorRegistry.Unlock()
+	extractors := []Extractor{extractor}
+	for _, value := range extractorRegistry.extractors {
+		if value.Name() != extractor.Name() {
+			extractors = append(extractors, value)
+		}
+	}
+	extractorRegistry.extractors = extractors
+}
+
+//detectExtractor return the extractor matched archive header.
+func detectExtractor(header []byte) (Extractor, error) {
+
+	extractorRegistry.RLock()
+	defer extractorRegistry.RUnlock()
+	for _, extractor := range extractorRegistry.extractors {
+		if extractor.Detect(header) {
+			return extractor, nil
+		}
+	}
+	return nil, ErrArchiveUnknown
+}
+
+//readHeader read archive header for format detecting, then seek to start.
+func readHeader(fd *os.File) ([]byte, error) {
+
+	header := make([]byte, magicSize)
+	n, err := io.ReadFull(fd, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+
+	if _, err := fd.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return header[:n], nil
+}
+
+//tarExtractor plain tar, detected by ustar magic or header checksum (v7 tar).
+type tarExtractor struct{}
+
+func (extractor *tarExtractor) Name() string {
+
+	return "tar"
+}
+
+func (extractor *tarExtractor) Detect(header []byte) bool {
+
+	if len(header) < magicSize {
+		return false
+	}
+
+	if bytes.HasPrefix(header[257:], []byte("ustar")) {
+		return true
+	}
+
+	field := strings.Trim(string(header[148:156]), " \x00")
+	checksum, err := strconv.ParseInt(field, 8, 64)
+	if err != nil {
+		return false
+	}
+
+	var sum int64
+	for i, b := range header {
+		if i >= 148 && i < 156 { //校验和字段按空格计算
+			b = ' '
+		}
+		sum += int64(b)
+	}
+	return sum == checksum
+}
+
+func (extractor *tarExtractor) Extract(archive *os.File, root string, limits *ExtractLimits) error {
+
+	return extractTar(tar.NewReader(bufio.NewReader(archive)), root, limits)
+}
+
+//tarGzipExtractor gzip compressed tar.
+type tarGzipExtractor struct{}
+
+func (extractor *tarGzipExtractor) Name() string {
+
+	return "tar.gz"
+}
+
+func (extractor *tarGzipExtractor) Detect(header []byte) bool {
+
+	return bytes.HasPrefix(header, []byte{0x1f, 0x8b})
+}
+
+func (extractor *tarGzipExtractor) Extract(archive *os.File, root string, limits *ExtractLimits) error {
+
+	gz, err := gzip.NewReader(bufio.NewReader(archive))
+	if err != nil {
+		return err
+	}
+
+	defer gz.Close()
+	return extractTar(tar.NewReader(gz), root, limits)
+}
+
+//tarZstdExtractor zstd compressed tar.
+type tarZstdExtractor struct{}
+
+func (extractor *tarZstdExtractor) Name() string {
+
+	return "tar.zst"
+}
+
+func (extractor *tarZstdExtractor) Detect(header []byte) bool {
+
+	return bytes.HasPrefix(header, []byte{0x28, 0xb5, 0x2f, 0xfd})
+}
+
+func (extractor *tarZstdExtractor) Extract(archive *os.File, root string, limits *ExtractLimits) error {
+
+	decoder, err := zstd.NewReader(bufio.NewReader(archive), zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(zstdMaxMemory))
+	if err != nil {
+		return err
+	}
+
+	defer decoder.Close()
+	return extractTar(tar.NewReader(decoder), root, limits)
+}
+
+/*
+zipExtractor zip文件包
+1、unix创建的zip保留文件权限与符号链接
+2、其它系统创建的zip没有权限信息, 以"#!"开头的文件设置为可执行
+*/
+type zipExtractor struct{}
+
+func (extractor *zipExtractor) Name() string {
+
+	return "zip"
+}
+
+func (extractor *zipExtractor) Detect(header []byte) bool {
+
+	return bytes.HasPrefix(header, []byte("PK\x03\x04")) || bytes.HasPrefix(header, []byte("PK\x05\x06"))
+}
+
+func (extractor *zipExtractor) Extract(archive *os.File, root string, limits *ExtractLimits) error {
+
+	info, err := archive.Stat()
+	if err != nil {
+		return err
+	}
+
+	reader, err := zip.NewReader(archive, info.Size())
+	if err != nil {
+		return err
+	}
+
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+
+	if len(reader.File) > limits.MaxEntries {
+		return &UnsafeArchiveError{Entry: reader.File[limits.MaxEntries].Name, Reason: fmt.Sprintf("entries exceed limit %d", limits.MaxEntries)}
+	}
+
+	var total int64
+	for _, file := range reader.File {
+		target, rel, err := resolveEntry(root, file.Name, limits)
+		if err != nil {
+			return err
+		}
+
+		if rel == "." {
+			continue
+		}
+
+		if err := checkParents(root, rel, file.Name); err != nil {
+			return err
+		}
+
+		mode := file.Mode()
+		switch {
+		case mode.IsDir() || strings.HasSuffix(file.Name, "/"):
+			if err := os.MkdirAll(target, mode.Perm()|0700); err != nil {
+				return err
+			}
+		case mode&os.ModeSymlink != 0:
+			linkname, err := readZipEntry(file, zipMaxLinkname)
+			if err != nil {
+				return err
+			}
+			if err := checkLink(root, target, string(linkname), file.Name, true); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0777); err != nil {
+				return err
+			}
+			os.Remove(target)
+			if err := os.Symlink(string(linkname), target); err != nil {
+				return err
+			}
+		case mode.IsRegular():
+			if total+int64(file.UncompressedSize64) > limits.MaxBytes || file.UncompressedSize64 > uint64(limits.MaxBytes) {
+				return &UnsafeArchiveError{Entry: file.Name, Reason: fmt.Sprintf("total size exceed limit %d", limits.MaxBytes)}
+			}
+			written, err := writeZipEntry(file, target, limits.MaxBytes-total)
+			total += written
+			if err != nil {
+				return err
+			}
+		default:
+			logger.WARN("[#cache#] extract ignore entry %s mode %s", file.Name, mode)
+		}
+	}
+	return checkSymlinks(root)
+}
+
+func readZipEntry(file *zip.File, max int64) ([]byte, error) {
+
+	rc, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+
+	defer rc.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(rc, max+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(data)) > max {
+		return nil, &UnsafeArchiveError{Entry: file.Name, Reason: "symlink target too long"}
+	}
+	return data, nil
+}
+
+//writeZipEntry write a regular file, zip created without unix modes make shebang scripts executable.
+func writeZipEntry(file *zip.File, target string, remain int64) (int64, error) {
+
+	rc, err := file.Open()
+	if err != nil {
+		return 0, err
+	}
+
+	defer rc.Close()
+	reader := bufio.NewReader(rc)
+	mode := file.Mode()
+	if file.CreatorVersion>>8 != zipCreatorUnix {
+		if magic, _ := reader.Peek(2); string(magic) == "#!" {
+			mode |= 0755
+		}
+	}
+	return writeEntry(target, reader, mode, remain)
+}
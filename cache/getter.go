@@ -1,7 +1,5 @@
 package cache
 
-import "github.com/cloudtask/libtools/gounits/compress/tarlib"
-import "github.com/cloudtask/libtools/gounits/utils"
 import "github.com/cloudtask/libtools/gounits/httpx"
 import "github.com/cloudtask/libtools/gounits/logger"
 import "github.com/cloudtask/libtools/gounits/system"
@@ -17,6 +15,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -65,6 +64,13 @@ const (
 	ERROR_PULLJOBFILE = -1002 //拉取任务文件失败
 	ERROR_DECOMPRESS  = -1003 //解压任务文件失败
 	ERROR_MAKECMDFILE = -1004 //上传任务文件为空，根据Cmd创建脚本文件失败
+	ERROR_VERIFYFILE  = -1005 //任务文件摘要或签名校验失败(已隔离，不再重试)
+	ERROR_LINKJOBFILE = -1006 //链接解压文件到任务目录失败
+	ERROR_UNSAFEFILE  = -1007 //任务文件包含越界路径、外部链接或超过解压限制(已隔离，不再重试)
+	ERROR_NOSPACE     = -1008 //缓存超过磁盘配额且无法回收空间
+	ERROR_OVERLOAD    = -1009 //分配的任务超过节点容量(MaxJobs)，拒绝激活
+	ERROR_PULLGITREPO = -1010 //拉取git仓库或检出commit失败
+	ERROR_SAVEJOBBASE = -1011 //写入job.json或package.json失败
 )
 
 /*
@@ -89,30 +95,59 @@ JobGet is exported
 待获取的Job状态信息
 */
 type JobGet struct {
-	JobId   string          //任务编号
-	JobData *models.JobData //任务分配数据
-	JobBase *models.JobBase //任务基础信息
-	State   GetState        //获取状态
+	JobId    string          //任务编号
+	JobData  *models.JobData //任务分配数据
+	JobBase  *models.JobBase //任务基础信息
+	Package  *PackageInfo    //任务文件校验信息
+	State    GetState        //获取状态
+	Attempts int             //连续失败次数
+	NextAt   time.Time       //下次重试时间
+	Error    *JobGetError    //最近一次失败原因
+	cancel   context.CancelFunc
 }
 
 /*
 JobGetter is exported
 Job信息获取器
 1、主要负责Job基础信息获取和Job文件包下载
-2、定时恢复失败Job信息或文件的拉取
-3、下载Job文件包成功负责解压生成目录结构，写入job.json信息文件
+2、拉取由固定数量的worker在getter锁之外并发执行, 每次拉取独立的context与超时
+3、同一job相同版本的重复请求合并, 新版本请求取消旧版本的拉取
+4、按指数退避恢复失败Job信息或文件的拉取, 文件支持断点续传
+5、下载Job文件包成功负责解压到blob存储并链接生成目录结构，写入job.json信息文件与package.json校验信息文件
 */
 type JobGetter struct {
-	sync.RWMutex                    //互斥锁对象
-	Root         string             //缓存根目录
-	Recovery     time.Duration      //恢复拉取间隔
-	CenterHost   string             //中心服务器API地址
-	WebsiteHost  string             //站点文件服务器API地址
-	exec         bool               //是否在执行恢复拉取
-	quit         chan bool          //退出下载
-	gets         map[string]*JobGet //下载任务集合
-	handler      IJobGetterHandler  //回调句柄
-	client       *httpx.HttpClient  //网络调用客户端
+	sync.RWMutex                         //互斥锁对象
+	Root         string                  //缓存根目录
+	Recovery     time.Duration           //恢复拉取最大退避间隔
+	Parallel     int                     //并发拉取数
+	Timeout      time.Duration           //单次拉取超时时长
+	CenterHost   string                  //中心服务器API地址
+	WebsiteHost  string                  //站点文件服务器API地址
+	PeerShare    bool                    //是否与同一runtime的agent共享job文件
+	PeerToken    string                  //请求peer文件时携带的bearer token, 与api token一致
+	peers        []string                //同一runtime其它agent的API地址
+	quited       bool                    //是否已退出
+	quit         chan struct{}           //退出下载
+	wakeCh       chan struct{}           //有新的拉取请求
+	tasks        chan *JobGet            //待worker执行的拉取
+	gets         map[string]*JobGet      //下载任务集合
+	packages     map[string]*PackageInfo //job文件包校验信息, 与job.json一起保存在package.json
+	files        map[string]*fileMutex   //文件包下载锁, 避免多个job同时写同一文件
+	handler      IJobGetterHandler       //回调句柄
+	client       *httpx.HttpClient       //网络调用客户端
+	httpClient   *http.Client            //文件下载客户端(支持Range续传)
+	downloads    *downloadTracker        //文件下载进度
+	verifier     *PackageVerifier        //文件包校验器
+	sources      *SourceSet              //文件包源
+	blobs        *BlobStore              //文件包解压存储
+	quota        *DiskQuota              //缓存磁盘配额
+	inuse        func() (map[string]bool, map[string]bool)
+}
+
+//fileMutex is a reference counted file lock.
+type fileMutex struct {
+	sync.Mutex
+	refs int
 }
 
 //NewJobGetter is exported
@@ -127,97 +162,134 @@ func NewJobGetter(configs *CacheConfigs, handler IJobGetterHandler) *JobGetter {
 		recovery = dur
 	}
 
-	client := httpx.NewClient().
-		SetTransport(&http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			DialContext: (&net.Dialer{
-				Timeout:   30 * time.Second,
-				KeepAlive: 60 * time.Second,
-			}).DialContext,
-			DisableKeepAlives:     false,
-			MaxIdleConns:          25,
-			MaxIdleConnsPerHost:   25,
-			IdleConnTimeout:       90 * time.Second,
-			TLSHandshakeTimeout:   http.DefaultTransport.(*http.Transport).TLSHandshakeTimeout,
-			ExpectContinueTimeout: http.DefaultTransport.(*http.Transport).ExpectContinueTimeout,
-		})
-
-	return &JobGetter{
-		exec:        false,
+	timeout, err := time.ParseDuration(configs.PullTimeout)
+	if err != nil || timeout <= 0 {
+		timeout = 10 * time.Minute
+	}
+
+	parallel := configs.PullParallel
+	if parallel <= 0 {
+		parallel = 4
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 60 * time.Second,
+		}).DialContext,
+		DisableKeepAlives:     false,
+		MaxIdleConns:          25,
+		MaxIdleConnsPerHost:   25,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   http.DefaultTransport.(*http.Transport).TLSHandshakeTimeout,
+		ExpectContinueTimeout: http.DefaultTransport.(*http.Transport).ExpectContinueTimeout,
+	}
+	client := httpx.NewClient().SetTransport(transport)
+
+	getter := &JobGetter{
+		quited:      false,
 		Root:        configs.SaveDirectory,
 		Recovery:    recovery,
+		Parallel:    parallel,
+		Timeout:     timeout,
 		CenterHost:  configs.CenterHost,
 		WebsiteHost: configs.WebsiteHost,
-		quit:        make(chan bool, 1),
+		PeerShare:   configs.PeerShare,
+		PeerToken:   configs.PeerToken,
+		quit:        make(chan struct{}),
+		wakeCh:      make(chan struct{}, 1),
+		tasks:       make(chan *JobGet),
 		gets:        make(map[string]*JobGet, 0),
+		packages:    make(map[string]*PackageInfo, 0),
+		files:       make(map[string]*fileMutex, 0),
 		handler:     handler,
 		client:      client,
+		httpClient:  &http.Client{Transport: transport},
+		downloads:   newDownloadTracker(),
+		verifier:    NewPackageVerifier(configs.TrustedKeys),
+		sources:     NewSourceSet(configs.Sources),
+	}
+	getter.blobs = NewBlobStore(configs)
+	getter.blobs.lock = getter.lockFile
+	getter.quota = NewDiskQuota(configs, getter.blobs)
+
+	go getter.schedule()
+	for i := 0; i < parallel; i++ {
+		go getter.work()
 	}
+	return getter
 }
 
 //Get is exported
-//get a jobbase and jobfile
+//get a jobbase and jobfile, the pull is executed by getter workers.
 func (getter *JobGetter) Get(jobdata *models.JobData) {
 
-	logger.INFO("[#cache#] getter get %s", jobdata.JobId)
-	getter.Remove(jobdata.JobId)
 	getter.Lock()
 	defer getter.Unlock()
-	jobbase, jobgeterror := getter.tryGetJobBase(jobdata)
-	if jobgeterror != nil {
-		jobget := &JobGet{JobId: jobdata.JobId, JobData: jobdata, JobBase: nil, State: GET_WAITING}
-		go func() {
-			getter.handler.OnJobGetterExceptionHandlerFunc("", jobget, jobgeterror)
-		}()
-		getter.gets[jobdata.JobId] = jobget
-		getter.execute()
+	if getter.quited {
 		return
 	}
-	workdir := getter.Root + "/" + jobbase.JobId + "/" + jobbase.FileCode
-	if jobgeterror := getter.tryGetJobFile(workdir, jobbase); jobgeterror != nil {
-		jobget := &JobGet{JobId: jobdata.JobId, JobData: jobdata, JobBase: jobbase, State: GET_WAITING}
-		go func() {
-			getter.handler.OnJobGetterExceptionHandlerFunc(workdir, jobget, jobgeterror)
-		}()
-		if jobgeterror.Code == ERROR_DECOMPRESS { //如果解压失败，不加入恢复gets尝试下载
-			logger.ERROR("[#cache#] getter error %d, %s", jobgeterror.Code, jobgeterror.Error.Error())
+
+	if jobget, ret := getter.gets[jobdata.JobId]; ret {
+		if jobget.JobData.Version == jobdata.Version { //相同版本正在拉取, 合并请求
+			logger.INFO("[#cache#] getter get %s version %d coalesced.", jobdata.JobId, jobdata.Version)
 			return
 		}
-		getter.gets[jobdata.JobId] = jobget
-		getter.execute()
-	} else {
-		getter.save(jobbase) //写job.json
+		getter.cancelGet(jobget)
+	}
+
+	logger.INFO("[#cache#] getter get %s", jobdata.JobId)
+	getter.gets[jobdata.JobId] = &JobGet{JobId: jobdata.JobId, JobData: jobdata, JobBase: nil, State: GET_WAITING}
+	select {
+	case getter.wakeCh <- struct{}{}:
+	default:
 	}
-	go func() { //=携程回调避免上层锁
-		getter.handler.OnJobGetterHandlerFunc(workdir, jobbase)
-	}()
 }
 
 func (getter *JobGetter) Remove(jobid string) {
 
 	logger.INFO("[#cache#] getter remove %s", jobid)
 	getter.Lock()
-	if ret := utils.Contains(jobid, getter.gets); ret {
-		delete(getter.gets, jobid)
+	if jobget, ret := getter.gets[jobid]; ret {
+		getter.cancelGet(jobget)
 	}
 	getter.Unlock()
+	getter.downloads.remove(jobid)
+}
+
+//GetDownloads is exported
+//return pulling jobfiles progress and retry state.
+func (getter *JobGetter) GetDownloads() []*DownloadProgress {
+
+	return getter.downloads.list()
 }
 
 func (getter *JobGetter) Quit() {
 
 	logger.INFO("[#cache#] cahce getter call quit.")
 	getter.Lock()
-	if getter.exec {
-		getter.quit <- true
+	if !getter.quited {
+		getter.quited = true
+		close(getter.quit)
 	}
-	for jobid := range getter.gets {
-		delete(getter.gets, jobid)
+	for _, jobget := range getter.gets {
+		getter.cancelGet(jobget)
 	}
-	close(getter.quit)
 	getter.Unlock()
 	logger.INFO("[#cache#] cahce getter quited....")
 }
 
+//cancelGet remove jobget and cancel its running pull, getter lock must be held.
+func (getter *JobGetter) cancelGet(jobget *JobGet) {
+
+	if jobget.cancel != nil {
+		jobget.cancel()
+		jobget.cancel = nil
+	}
+	delete(getter.gets, jobget.JobId)
+}
+
 func (getter *JobGetter) Check(jobbase *models.JobBase) bool {
 
 	if strings.TrimSpace(jobbase.FileName) != "" {
@@ -253,8 +325,19 @@ func (getter *JobGetter) Load() []*models.JobBase {
 		return jobs
 	}
 
+	for _, removed := range getter.blobs.CleanTemp() {
+		logger.WARN("[#cache#] getter clean leftover blob %s", removed)
+	}
+
+	for _, removed := range cleanGitTemp(getter.Root + "/" + gitMirrors) {
+		logger.WARN("[#cache#] getter clean leftover git %s", removed)
+	}
+
 	for _, fic := range fis {
 		if fic.IsDir() {
+			for _, removed := range cleanStaging(getter.Root + "/" + fic.Name()) {
+				logger.WARN("[#cache#] getter clean leftover staging %s", removed)
+			}
 			fpath := getter.Root + "/" + fic.Name() + "/job.json"
 			if ret := system.FileExist(fpath); ret {
 				fd, err := os.OpenFile(fpath, os.O_RDONLY, 0777)
@@ -270,6 +353,11 @@ func (getter *JobGetter) Load() []*models.JobBase {
 				}
 				if getter.Check(jobbase) {
 					jobs = append(jobs, jobbase)
+					if pkg := getter.loadPackage(jobbase.JobId); pkg != nil {
+						getter.Lock()
+						getter.packages[jobbase.JobId] = pkg
+						getter.Unlock()
+					}
 				}
 				fd.Close()
 			}
@@ -278,9 +366,36 @@ func (getter *JobGetter) Load() []*models.JobBase {
 	return jobs
 }
 
-func (getter *JobGetter) save(jobbase *models.JobBase) error {
+/*
+save 写job.json与package.json
+package.json先于job.json写入, 重启后job.json存在时校验信息同样可用; 没有校验信息时删除旧的package.json.
+*/
+func (getter *JobGetter) save(jobbase *models.JobBase, pkg *PackageInfo) error {
 
 	logger.INFO("[#cache#] getter save job %s", jobbase.JobId)
+	jobroot := getter.Root + "/" + jobbase.JobId
+	if pkg == nil || *pkg == (PackageInfo{}) {
+		pkg = nil
+		os.Remove(jobroot + "/package.json")
+	} else {
+		data, err := json.Marshal(pkg)
+		if err == nil {
+			err = writeFileAtomic(jobroot+"/package.json", data, 0777)
+		}
+		if err != nil {
+			logger.ERROR("[#cache#] getter save package.json err, %s, %s", jobbase.JobId, err.Error())
+			return err
+		}
+	}
+
+	getter.Lock()
+	if pkg != nil {
+		getter.packages[jobbase.JobId] = pkg
+	} else {
+		delete(getter.packages, jobbase.JobId)
+	}
+	getter.Unlock()
+
 	buf := bytes.NewBuffer([]byte{})
 	err := json.NewEncoder(buf).Encode(jobbase)
 	if err != nil {
@@ -288,163 +403,348 @@ func (getter *JobGetter) save(jobbase *models.JobBase) error {
 		return err
 	}
 
-	jobroot := getter.Root + "/" + jobbase.JobId
-	err = ioutil.WriteFile(jobroot+"/job.json", buf.Bytes(), 0777)
+	err = writeFileAtomic(jobroot+"/job.json", buf.Bytes(), 0777)
 	if err != nil {
 		logger.ERROR("[#cache#] getter save job.json write err, %s, %s", jobbase.JobId, err.Error())
 	}
 	return err
 }
 
-func (getter *JobGetter) execute() {
-
-	count := len(getter.gets)
-	if count > 0 && !getter.exec {
-		getter.exec = true
-		logger.INFO("[#cache#] getter start execute %d....", count)
-		go func() {
-		NEW_TICK_DURATION:
-			ticker := time.NewTicker(getter.Recovery)
-			for {
-				select {
-				case <-getter.quit:
-					{
-						ticker.Stop()
-						getter.exec = false
-						logger.INFO("[#cache#] getter quit execute....")
-						return
-					}
-				case <-ticker.C:
-					{
-						ticker.Stop()
-						getter.Lock()
-						getter.doGet()
-						if len(getter.gets) == 0 {
-							getter.exec = false
-							getter.Unlock()
-							logger.INFO("[#cache#] getter quit execute....")
-							return
-						}
-						getter.Unlock()
-						goto NEW_TICK_DURATION
-					}
-				}
-			}
-		}()
+//loadPackage read package.json of a job, return nil if not exists.
+func (getter *JobGetter) loadPackage(jobid string) *PackageInfo {
+
+	data, err := ioutil.ReadFile(getter.Root + "/" + jobid + "/package.json")
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.ERROR("[#cache#] getter read package.json err, %s, %s", jobid, err.Error())
+		}
+		return nil
 	}
+
+	pkg := &PackageInfo{}
+	if err := json.Unmarshal(data, pkg); err != nil {
+		logger.ERROR("[#cache#] getter decode package.json err, %s, %s", jobid, err.Error())
+		return nil
+	}
+	return pkg
 }
 
-func (getter *JobGetter) doGet() {
+//schedule dispatch due jobgets to workers.
+func (getter *JobGetter) schedule() {
 
-	for jobid, jobget := range getter.gets {
-		iscallback := false
-		if jobget.JobBase == nil {
-			jobbase, jobgeterror := getter.tryGetJobBase(jobget.JobData)
-			if jobgeterror != nil {
-				getter.handler.OnJobGetterExceptionHandlerFunc("", jobget, jobgeterror)
-				continue
+	ticker := time.NewTicker(retryTickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-getter.quit:
+			logger.INFO("[#cache#] getter quit schedule....")
+			return
+		case <-getter.wakeCh:
+		case <-ticker.C:
+		}
+		for _, jobget := range getter.dueGets() {
+			select {
+			case getter.tasks <- jobget:
+			case <-getter.quit:
+				logger.INFO("[#cache#] getter quit schedule....")
+				return
 			}
-			jobget.JobBase = jobbase
-			iscallback = true
 		}
+	}
+}
 
-		var workdir string
-		if jobget.JobBase != nil {
-			workdir = getter.Root + "/" + jobget.JobBase.JobId + "/" + jobget.JobBase.FileCode
-		}
+//dueGets return waiting jobgets which reached retry time and mark them doing.
+func (getter *JobGetter) dueGets() []*JobGet {
 
-		if jobget.State == GET_WAITING {
+	now := time.Now()
+	jobgets := []*JobGet{}
+	getter.Lock()
+	for _, jobget := range getter.gets {
+		if jobget.State == GET_WAITING && !now.Before(jobget.NextAt) {
 			jobget.State = GET_DOING
-			if jobgeterror := getter.tryGetJobFile(workdir, jobget.JobBase); jobgeterror != nil {
-				jobget.State = GET_WAITING
-				getter.handler.OnJobGetterExceptionHandlerFunc(workdir, jobget, jobgeterror)
-				if jobgeterror.Code == ERROR_DECOMPRESS {
-					delete(getter.gets, jobid) //拉取成功解压失败，从恢复gets删除不再尝试下载.
-					continue
-				}
-			} else {
-				if jobget.JobBase != nil {
-					delete(getter.gets, jobid)  //拉取文件,拉取成功删除jobget
-					getter.save(jobget.JobBase) //写job.json
-				}
-			}
+			jobgets = append(jobgets, jobget)
+		}
+	}
+	getter.Unlock()
+	return jobgets
+}
+
+func (getter *JobGetter) work() {
+
+	for {
+		select {
+		case <-getter.quit:
+			return
+		case jobget := <-getter.tasks:
+			getter.doGet(jobget)
 		}
+	}
+}
+
+//retryLater set jobget next retry time with exponential backoff, getter lock must be held.
+func (getter *JobGetter) retryLater(jobget *JobGet, jobgeterror *JobGetError) {
+
+	jobget.Attempts++
+	jobget.Error = jobgeterror
+	jobget.NextAt = time.Now().Add(retryBackoff(jobget.Attempts, getter.Recovery))
+	getter.downloads.retry(jobget.JobId, jobget.Attempts, jobget.NextAt, jobgeterror.String())
+	logger.WARN("[#cache#] getter %s failed %d times, retry at %s.", jobget.JobId, jobget.Attempts, jobget.NextAt.Format(time.RFC3339))
+}
+
+//doGet pull a jobget outside the getter lock, the result is dropped if jobget removed or replaced during pull.
+func (getter *JobGetter) doGet(jobget *JobGet) {
+
+	getter.Lock()
+	if getter.gets[jobget.JobId] != jobget {
+		getter.Unlock()
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), getter.Timeout)
+	jobget.cancel = cancel
+	jobbase, pkg := jobget.JobBase, jobget.Package
+	getter.Unlock()
+	defer cancel()
+
+	var workdir string
+	var jobgeterror *JobGetError
+	iscallback := false
+	if jobbase == nil {
+		jobbase, pkg, jobgeterror = getter.tryGetJobBase(ctx, jobget.JobData)
+		iscallback = jobgeterror == nil
+	}
+
+	if jobgeterror == nil {
+		workdir = getter.Root + "/" + jobbase.JobId + "/" + jobbase.FileCode
+		unlock := getter.lockFile(jobbase.FileName)
+		jobgeterror = getter.tryGetJobFile(ctx, workdir, jobbase, pkg)
+		unlock()
+	}
+
+	unlockJob := getter.lockFile(jobget.JobId + "/job.json") //同一job的多次拉取按顺序写job.json, 旧版本不会覆盖新版本
+	defer unlockJob()
+	getter.RLock()
+	current := getter.gets[jobget.JobId] == jobget
+	getter.RUnlock()
+	if current && jobgeterror == nil {
+		if err := getter.save(jobbase, pkg); err != nil { //未写入时重启后job丢失或缺少校验信息, 稍后重试
+			jobgeterror = &JobGetError{Code: ERROR_SAVEJOBBASE, Error: errors.New("getter save job error " + jobbase.JobId + ", " + err.Error())}
+		}
+	}
+
+	getter.Lock()
+	if getter.gets[jobget.JobId] != jobget { //拉取过程中已被删除或被新版本替换
+		getter.Unlock()
+		logger.INFO("[#cache#] getter %s removed during pull, result dropped.", jobget.JobId)
+		return
+	}
+
+	jobget.cancel = nil
+	jobget.JobBase = jobbase
+	jobget.Package = pkg
+	giveup := jobgeterror != nil && (jobgeterror.Code == ERROR_DECOMPRESS || jobgeterror.Code == ERROR_VERIFYFILE || jobgeterror.Code == ERROR_UNSAFEFILE)
+	if jobgeterror == nil || giveup {
+		delete(getter.gets, jobget.JobId) //拉取成功或解压/校验失败，从恢复gets删除不再尝试下载.
+		getter.downloads.remove(jobget.JobId)
+	} else {
+		jobget.State = GET_WAITING
+		getter.retryLater(jobget, jobgeterror)
+	}
+	getter.Unlock()
 
-		if iscallback {
-			getter.handler.OnJobGetterHandlerFunc(workdir, jobget.JobBase)
+	if jobgeterror != nil {
+		if giveup {
+			logger.ERROR("[#cache#] getter error %d, %s", jobgeterror.Code, jobgeterror.Error.Error())
 		}
+		getter.handler.OnJobGetterExceptionHandlerFunc(workdir, jobget, jobgeterror)
+	}
+
+	if iscallback && !giveup {
+		getter.handler.OnJobGetterHandlerFunc(workdir, jobbase)
 	}
 }
 
-func (getter *JobGetter) tryGetJobBase(jobdata *models.JobData) (*models.JobBase, *JobGetError) {
+//lockFile lock a jobfile download, return unlock func.
+func (getter *JobGetter) lockFile(filename string) func() {
+
+	getter.Lock()
+	mutex, ret := getter.files[filename]
+	if !ret {
+		mutex = &fileMutex{}
+		getter.files[filename] = mutex
+	}
+	mutex.refs++
+	getter.Unlock()
+	mutex.Lock()
+	return func() {
+		mutex.Unlock()
+		getter.Lock()
+		mutex.refs--
+		if mutex.refs == 0 {
+			delete(getter.files, filename)
+		}
+		getter.Unlock()
+	}
+}
+
+func (getter *JobGetter) tryGetJobBase(ctx context.Context, jobdata *models.JobData) (*models.JobBase, *PackageInfo, *JobGetError) {
 
 	logger.INFO("[#cache#] getter try getjobbase, %s", jobdata.JobId)
-	resp, err := getter.client.Get(context.Background(), getter.CenterHost+"/cloudtask/v2/jobs/"+jobdata.JobId+"/base", nil, nil)
+	resp, err := getter.client.Get(ctx, getter.CenterHost+"/cloudtask/v2/jobs/"+jobdata.JobId+"/base", nil, nil)
 	if err != nil {
-		return nil, &JobGetError{Code: ERROR_GETJOBBASE, Error: fmt.Errorf("jobgetter getjobbase http error:%s", err.Error())}
+		return nil, nil, &JobGetError{Code: ERROR_GETJOBBASE, Error: fmt.Errorf("jobgetter getjobbase http error:%s", err.Error())}
 	}
 
 	defer resp.Close()
 	statuscode := resp.StatusCode()
 	if statuscode != http.StatusOK {
-		return nil, &JobGetError{Code: ERROR_GETJOBBASE, Error: fmt.Errorf("jobgetter getjobbase http code:%d", statuscode)}
+		return nil, nil, &JobGetError{Code: ERROR_GETJOBBASE, Error: fmt.Errorf("jobgetter getjobbase http code:%d", statuscode)}
 	}
 
-	jobbase := &models.JobBase{}
-	if err := resp.JSON(jobbase); err != nil {
-		return nil, &JobGetError{Code: ERROR_GETJOBBASE, Error: fmt.Errorf("jobgetter getjobbase decode data error:%s", err.Error())}
+	data := &jobBaseResponse{JobBase: &models.JobBase{}}
+	if err := resp.JSON(data); err != nil {
+		return nil, nil, &JobGetError{Code: ERROR_GETJOBBASE, Error: fmt.Errorf("jobgetter getjobbase decode data error:%s", err.Error())}
 	}
+	jobbase := data.JobBase
 	jobbase.Version = jobdata.Version
-	return jobbase, nil
+	if strings.TrimSpace(data.GitRepo) != "" { //git仓库job没有文件包
+		jobbase.FileName = ""
+	}
+	return jobbase, &data.PackageInfo, nil
 }
 
-func (getter *JobGetter) tryGetJobFile(jobdirectory string, jobbase *models.JobBase) *JobGetError {
+/*
+tryGetJobFile 拉取job文件并生成job目录
+job目录不存在时先在暂存目录中链接文件、生成命令文件, 完成后原子rename为job目录.
+*/
+func (getter *JobGetter) tryGetJobFile(ctx context.Context, jobdirectory string, jobbase *models.JobBase, pkg *PackageInfo) *JobGetError {
 
-	if strings.TrimSpace(jobbase.FileName) != "" {
-		jobGetError := getter.pullJobFile(jobdirectory, jobbase)
-		if jobGetError != nil {
+	if ret, _ := system.PathExists(jobdirectory); ret { //已激活的job目录
+		if strings.TrimSpace(jobbase.FileName) != "" && (pkg == nil || strings.TrimSpace(pkg.GitRepo) == "") {
+			if jobGetError := getter.pullJobFile(ctx, "", jobbase, pkg); jobGetError != nil {
+				return jobGetError
+			}
+		}
+		cmd, err := createCommandFile(jobdirectory, jobbase.Cmd)
+		if err != nil {
+			return &JobGetError{Code: ERROR_MAKECMDFILE, Error: err}
+		}
+		jobbase.Cmd = cmd
+		return nil
+	}
+
+	staging := stagingDirectory(jobdirectory)
+	os.RemoveAll(staging)
+	if pkg != nil && strings.TrimSpace(pkg.GitRepo) != "" { //git仓库检出commit
+		if jobGetError := getter.pullGitRepo(ctx, staging, jobbase, pkg); jobGetError != nil {
+			os.RemoveAll(staging)
+			return jobGetError
+		}
+	} else if strings.TrimSpace(jobbase.FileName) != "" {
+		if jobGetError := getter.pullJobFile(ctx, staging, jobbase, pkg); jobGetError != nil {
+			os.RemoveAll(staging)
 			return jobGetError
 		}
 	}
 
-	if ret, _ := system.PathExists(jobdirectory); !ret {
-		if err := system.MakeDirectory(jobdirectory); err != nil {
+	if ret, _ := system.PathExists(staging); !ret {
+		if err := system.MakeDirectory(staging); err != nil {
 			return &JobGetError{Code: ERROR_MAKECMDFILE, Error: err}
 		}
 	}
 
-	cmd, err := createCommandFile(jobdirectory, jobbase.Cmd)
+	cmd, err := createCommandFile(staging, jobbase.Cmd)
 	if err != nil {
+		os.RemoveAll(staging)
 		return &JobGetError{Code: ERROR_MAKECMDFILE, Error: err}
 	}
+
+	if err := activateDirectory(staging, jobdirectory); err != nil {
+		os.RemoveAll(staging)
+		return &JobGetError{Code: ERROR_LINKJOBFILE, Error: err}
+	}
 	jobbase.Cmd = cmd
 	return nil
 }
 
-func (getter *JobGetter) pullJobFile(jobdirectory string, jobbase *models.JobBase) *JobGetError {
+/*
+pullJobFile 拉取job文件, staging不为空时校验、解压并链接到staging目录.
+*/
+func (getter *JobGetter) pullJobFile(ctx context.Context, staging string, jobbase *models.JobBase, pkg *PackageInfo) *JobGetError {
 
 	logger.INFO("[#cache#] getter pull jobfile %s", jobbase.FileName)
-	jobroot := getter.Root + "/" + jobbase.JobId                              //job所在根目录
-	jobfile := getter.Root + "/jobs/" + jobbase.FileName                      //job文件下载到本地的路径
-	remoteurl := getter.WebsiteHost + "/api/file/default/" + jobbase.FileName //job文件远程下载路径
-	if ret := system.FileExist(jobfile); !ret {
-		if err := getter.client.GetFile(context.Background(), jobfile, remoteurl, nil, nil); err != nil {
-			err = errors.New("getter pull jobfile error " + remoteurl + ", " + err.Error())
+	jobfile := getter.Root + "/jobs/" + jobbase.FileName //job文件下载到本地的路径
+	source := jobbase.FileName                           //job文件来源, 用于错误信息
+	if jobGetError := getter.reclaimSpace(jobfile, staging != ""); jobGetError != nil {
+		return jobGetError
+	}
+
+	if ret := system.FileExist(jobfile); !ret && !getter.pullFromPeers(ctx, jobbase.JobId, jobfile, jobbase.FileName, pkg) {
+		name, err := getter.pullFromSources(ctx, jobbase.JobId, jobfile, jobbase.FileName)
+		if err != nil {
+			err = errors.New("getter pull jobfile error " + jobbase.FileName + ", " + err.Error())
 			return &JobGetError{Code: ERROR_PULLJOBFILE, Error: err}
 		}
+		source = jobbase.FileName + " from source " + name
 	}
 
-	if ret, _ := system.PathExists(jobdirectory); !ret {
-		tempdir := jobroot + "/temp"
-		if err := tarlib.TarAutoDeCompress(jobfile, tempdir); err != nil {
-			os.RemoveAll(tempdir)
-			os.RemoveAll(jobroot)
+	if staging != "" {
+		if err := getter.verifier.Verify(jobfile, pkg); err != nil { //解压前校验文件摘要与签名
+			quarantineFile(getter.Root, jobfile)
+			err = errors.New("getter verify jobfile error " + source + ", " + err.Error())
+			return &JobGetError{Code: ERROR_VERIFYFILE, Error: err}
+		}
+		digest, err := getter.blobs.Digest(jobfile)
+		if err != nil {
+			err = errors.New("getter digest jobfile error " + jobfile + ", " + err.Error())
+			return &JobGetError{Code: ERROR_PULLJOBFILE, Error: err}
+		}
+		unlock := getter.lockFile(blobTree + "/" + digest) //同一文件包只解压一次
+		defer unlock()
+		tree, err := getter.blobs.Extract(digest, jobfile)
+		if _, ret := err.(*UnsafeArchiveError); ret {
+			quarantineFile(getter.Root, jobfile)
+			err = errors.New("getter decompress jobfile unsafe " + source + ", " + err.Error())
+			return &JobGetError{Code: ERROR_UNSAFEFILE, Error: err}
+		}
+		if err != nil {
 			os.Remove(jobfile)
-			err = errors.New("getter decompress jobfile error " + remoteurl + ", " + err.Error())
+			err = errors.New("getter decompress jobfile error " + source + ", " + err.Error())
 			return &JobGetError{Code: ERROR_DECOMPRESS, Error: err}
 		}
-		system.DirectoryCopy(tempdir, jobdirectory)
-		os.RemoveAll(tempdir)
+		if err := getter.blobs.Link(digest, tree, jobbase.JobId, jobbase.FileCode, staging); err != nil {
+			os.RemoveAll(staging)
+			err = errors.New("getter link jobfile error " + staging + ", " + err.Error())
+			return &JobGetError{Code: ERROR_LINKJOBFILE, Error: err}
+		}
+	}
+	return nil
+}
+
+//reclaimSpace evict unused cache by LRU before pulling or extracting, refuse the pull if space can not be reclaimed.
+func (getter *JobGetter) reclaimSpace(jobfile string, extract bool) *JobGetError {
+
+	if !getter.quota.Enabled() {
+		return nil
+	}
+
+	if system.FileExist(jobfile) && !extract {
+		return nil
+	}
+
+	jobids, files := map[string]bool{}, map[string]bool{}
+	if getter.inuse != nil {
+		jobids, files = getter.inuse()
+	}
+
+	getter.RLock()
+	for filename := range getter.files { //正在下载或解压的文件
+		files[filename] = true
+	}
+	getter.RUnlock()
+
+	if err := getter.quota.Reclaim(jobids, files); err != nil {
+		err = errors.New("getter refuse pull " + filepath.Base(jobfile) + ", " + err.Error())
+		return &JobGetError{Code: ERROR_NOSPACE, Error: err}
 	}
 	return nil
 }
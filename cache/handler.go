@@ -8,6 +8,8 @@ const (
 	CACHE_EVENT_JOBERROR  CacheEvent = "CACHE_EVENT_JOBERROR"
 	CACHE_EVENT_JOBSET    CacheEvent = "CACHE_EVENT_JOBSET"
 	CACHE_EVENT_JOBREMOVE CacheEvent = "CACHE_EVENT_JOBREMOVE"
+	CACHE_EVENT_JOBPURGE  CacheEvent = "CACHE_EVENT_JOBPURGE"
+	CACHE_EVENT_JOBREJECT CacheEvent = "CACHE_EVENT_JOBREJECT"
 )
 
 //ICacheHandler is exported
@@ -5,8 +5,11 @@ import "github.com/cloudtask/libtools/gounits/logger"
 
 import (
 	"bytes"
+	"crypto/sha1"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"sync"
 )
 
@@ -17,6 +20,12 @@ type JobStore struct {
 	alloc             *models.JobsAlloc            //任务分配表
 	getter            *JobGetter                   //任务信息获取器
 	jobs              map[string]*models.JobBase   //任务信息本地缓存
+	allocTracker      *AllocTracker                //任务分配记录
+	loaded            map[string]int               //启动时读取的job.json版本, 离线恢复分配表时使用
+	offline           bool                         //分配表由本地恢复, 下一次集群分配表无条件生效
+	digest            [sha1.Size]byte              //最后一次处理的集群分配表摘要, 未改变时跳过解码
+	maxJobs           int                          //节点最多激活的任务数, <=0不限制
+	rejected          map[string]*models.JobData   //超过节点容量被拒绝的任务
 	changedCallback   JobCacheChangedHandlerFunc   //任务改变回调
 	exceptionCallback JobCacheExceptionHandlerFunc //任务异常回调
 }
@@ -24,6 +33,7 @@ type JobStore struct {
 //NewJobStore is exported
 //jobs & alloc cache
 func NewJobStore(configs *CacheConfigs,
+	allocTracker *AllocTracker,
 	changedCallback JobCacheChangedHandlerFunc,
 	exceptionCallback JobCacheExceptionHandlerFunc) *JobStore {
 
@@ -35,11 +45,17 @@ func NewJobStore(configs *CacheConfigs,
 	store := &JobStore{
 		alloc:             alloc,
 		jobs:              make(map[string]*models.JobBase, 0),
+		allocTracker:      allocTracker,
+		loaded:            make(map[string]int),
+		offline:           false,
+		maxJobs:           configs.MaxJobs,
+		rejected:          make(map[string]*models.JobData),
 		changedCallback:   changedCallback,
 		exceptionCallback: exceptionCallback,
 	}
 
 	store.getter = NewJobGetter(configs, store)
+	store.getter.inuse = store.inUse
 	return store
 }
 
@@ -50,6 +66,25 @@ func (store *JobStore) SetServerConfigsParameter(centerHost string, websiteHost
 	store.getter.WebsiteHost = websiteHost
 }
 
+//SetPeers is exported
+func (store *JobStore) SetPeers(peers []string) {
+
+	store.getter.SetPeers(peers)
+}
+
+//OpenJobFile is exported
+func (store *JobStore) OpenJobFile(filename string) (*os.File, error) {
+
+	return store.getter.OpenJobFile(filename)
+}
+
+//GetDownloads is exported
+//return pulling jobfiles progress.
+func (store *JobStore) GetDownloads() []*DownloadProgress {
+
+	return store.getter.GetDownloads()
+}
+
 //GetAllocVersion is exported
 //return jobs alloc version.
 func (store *JobStore) GetAllocVersion() int {
@@ -67,6 +102,7 @@ func (store *JobStore) LoadJobs() {
 	store.Lock()
 	result := store.getter.Load()
 	for _, jobbase := range result {
+		store.loaded[jobbase.JobId] = jobbase.Version
 		jobbase.Version = 0 //first load, set version to memory is zero, wait re-alloc.
 		store.jobs[jobbase.JobId] = jobbase
 		logger.INFO("[#cache#] read jobid:%s fcode:%s version:%d", jobbase.JobId, jobbase.FileCode, jobbase.Version)
@@ -115,6 +151,70 @@ func (store *JobStore) GetJob(jobid string) *models.JobBase {
 	return nil
 }
 
+//GetStatus is exported
+//return alloc version, allocated jobs cache state, getter jobgets and disk usage.
+func (store *JobStore) GetStatus() *CacheStatus {
+
+	status := &CacheStatus{Jobs: []*JobCacheStatus{}, Rejected: []*models.JobData{}}
+	store.RLock()
+	status.AllocVersion = store.alloc.Version
+	status.MaxJobs = store.maxJobs
+	for _, jobdata := range store.rejected {
+		status.Rejected = append(status.Rejected, jobdata)
+	}
+	for _, jobdata := range store.alloc.Jobs {
+		status.Jobs = append(status.Jobs, store.jobCacheStatus(jobdata))
+	}
+	status.Gets = store.getter.GetStatus()
+	store.RUnlock()
+	status.Disk = store.getter.GetDiskUsage()
+	return status
+}
+
+//GetSources is exported
+//return package sources and their health.
+func (store *JobStore) GetSources() []*SourceStatus {
+
+	return store.getter.sources.List()
+}
+
+//GetJobStatus is exported
+//return a allocated job cache, getter and download state, job not allocated return nil.
+func (store *JobStore) GetJobStatus(jobid string) *JobStatus {
+
+	store.RLock()
+	defer store.RUnlock()
+	for _, jobdata := range store.alloc.Jobs {
+		if jobdata.JobId == jobid {
+			return &JobStatus{
+				JobCacheStatus: *store.jobCacheStatus(jobdata),
+				Get:            store.getter.GetJobStatus(jobid),
+				Download:       store.getter.GetDownload(jobid),
+			}
+		}
+	}
+	return nil
+}
+
+//jobCacheStatus store lock must be held.
+func (store *JobStore) jobCacheStatus(jobdata *models.JobData) *JobCacheStatus {
+
+	status := &JobCacheStatus{
+		JobId:        jobdata.JobId,
+		AllocVersion: jobdata.Version,
+	}
+
+	if jobbase, ret := store.jobs[jobdata.JobId]; ret {
+		status.Cached = true
+		status.Version = jobbase.Version
+		status.FileName = jobbase.FileName
+		status.FileCode = jobbase.FileCode
+		status.Check = store.getter.Check(jobbase)
+		status.Source = store.getter.sources.Served(jobbase.FileName)
+	}
+	return status
+}
+
 //ClearJobs is exported
 //clear all cache jobs and alloc.
 func (store *JobStore) ClearJobs() {
@@ -144,8 +244,14 @@ func (store *JobStore) MakeAllocBuffer() ([]byte, error) {
 //alloc changed, set alloc data.
 func (store *JobStore) SetAllocBuffer(key string, data []byte) error {
 
-	store.Lock()
-	defer store.Unlock()
+	digest := sha1.Sum(data)
+	store.RLock()
+	unchanged := !store.offline && digest == store.digest
+	store.RUnlock()
+	if unchanged { //分配表未改变, 跳过解码
+		return nil
+	}
+
 	tempalloc := &models.JobsAlloc{
 		Version: 0,
 		Jobs:    make([]*models.JobData, 0),
@@ -155,32 +261,99 @@ func (store *JobStore) SetAllocBuffer(key string, data []byte) error {
 		return err
 	}
 
-	if tempalloc.Version == 0 || tempalloc.Version == store.alloc.Version {
+	if tempalloc.Version == 0 {
 		return nil
 	}
 
-	if tempalloc.Version < store.alloc.Version && store.alloc.Version != 0 {
-		return fmt.Errorf("josalloc version invalid. tempalloc:%d storealloc:%d", tempalloc.Version, store.alloc.Version)
+	tempalloc.Jobs = filterJobs(key, tempalloc.Jobs) //在锁外筛选本实例的任务
+	store.Lock()
+	defer store.Unlock()
+	if store.offline { //集群恢复, 以集群分配表为准
+		logger.INFO("[#cache#] cluster alloc version %d arrived, reconcile offline alloc version %d.", tempalloc.Version, store.alloc.Version)
+		store.offline = false
+	} else {
+		if tempalloc.Version == store.alloc.Version {
+			store.digest = digest
+			return nil
+		}
+		if tempalloc.Version < store.alloc.Version && store.alloc.Version != 0 {
+			return fmt.Errorf("josalloc version invalid. tempalloc:%d storealloc:%d", tempalloc.Version, store.alloc.Version)
+		}
+	}
+
+	store.applyAlloc(tempalloc)
+	store.digest = digest
+	store.saveAlloc()
+	return nil
+}
+
+/*
+RestoreAlloc is exported
+离线模式: 集群不可达时从SaveDirectory/alloc.json恢复最后一次生效的分配表.
+本地文件完整且版本一致的job直接调度, 集群分配表到达后重新对账.
+*/
+func (store *JobStore) RestoreAlloc(key string) (int, error) {
+
+	data, err := ioutil.ReadFile(store.allocFile())
+	if err != nil {
+		return -1, err
+	}
+
+	tempalloc := &models.JobsAlloc{
+		Version: 0,
+		Jobs:    make([]*models.JobData, 0),
+	}
+
+	if err := models.JobsAllocDeCode(data, tempalloc); err != nil {
+		return -1, err
+	}
+
+	tempalloc.Jobs = filterJobs(key, tempalloc.Jobs)
+	store.Lock()
+	defer store.Unlock()
+	if store.alloc.Version != 0 { //已收到集群分配表
+		return store.alloc.Version, nil
 	}
 
-	for i := len(tempalloc.Jobs) - 1; i >= 0; i-- {
-		if tempalloc.Jobs[i].Key != key { //筛选非本实例的任务
-			tempalloc.Jobs = append(tempalloc.Jobs[:i], tempalloc.Jobs[i+1:]...)
+	for jobid, version := range store.loaded {
+		if jobbase, ret := store.jobs[jobid]; ret {
+			jobbase.Version = version
 		}
 	}
+	store.offline = true
+	store.applyAlloc(tempalloc)
+	logger.INFO("[#cache#] restore offline alloc version %d, jobs count %d.", store.alloc.Version, len(store.alloc.Jobs))
+	return store.alloc.Version, nil
+}
 
-	var found bool
-	for i := len(store.alloc.Jobs) - 1; i >= 0; i-- {
-		found = false
-		jobdata := store.alloc.Jobs[i]
-		for j := 0; j < len(tempalloc.Jobs); j++ {
-			if jobdata.JobId == tempalloc.Jobs[j].JobId {
-				found = true
-				break
-			}
+//filterJobs return jobs allocated to key.
+func filterJobs(key string, jobs []*models.JobData) []*models.JobData {
+
+	filtered := make([]*models.JobData, 0, len(jobs))
+	for _, jobdata := range jobs {
+		if jobdata.Key == key {
+			filtered = append(filtered, jobdata)
 		}
-		if !found { //找出被删除的任务
-			store.alloc.Jobs = append(store.alloc.Jobs[:i], store.alloc.Jobs[i+1:]...)
+	}
+	return filtered
+}
+
+//applyAlloc diff and apply alloc of this node, store lock must be held.
+func (store *JobStore) applyAlloc(tempalloc *models.JobsAlloc) {
+
+	tempalloc.Jobs = store.limitJobs(tempalloc.Jobs)
+	jobids := make([]string, 0, len(tempalloc.Jobs))
+	allocated := make(map[string]*models.JobData, len(tempalloc.Jobs))
+	for _, jobdata := range tempalloc.Jobs {
+		jobids = append(jobids, jobdata.JobId)
+		allocated[jobdata.JobId] = jobdata
+	}
+	store.allocTracker.SetAllocated(jobids) //记录分配时间, 先于拉取避免目录被清理
+
+	origin := make(map[string]*models.JobData, len(store.alloc.Jobs))
+	for _, jobdata := range store.alloc.Jobs {
+		origin[jobdata.JobId] = jobdata
+		if _, ret := allocated[jobdata.JobId]; !ret { //找出被删除的任务
 			store.getter.Remove(jobdata.JobId) //从下载器中删除
 			if jobbase, ret := store.jobs[jobdata.JobId]; ret {
 				jobbase.Version = 0 //remove job, re-set job version to zero, wait re-alloc.
@@ -190,34 +363,111 @@ func (store *JobStore) SetAllocBuffer(key string, data []byte) error {
 		}
 	}
 
-	for i := 0; i < len(tempalloc.Jobs); i++ {
-		found = false
-		jobdata := tempalloc.Jobs[i]
-		for j := 0; j < len(store.alloc.Jobs); j++ { //找出版本号已改变的任务(任务更新)
-			if jobdata.JobId == store.alloc.Jobs[j].JobId {
-				if jobdata.Version > store.alloc.Jobs[j].Version {
-					store.alloc.Jobs[j] = jobdata
-					jobbase := store.tryGet(jobdata)
-					if jobbase != nil {
-						logger.INFO("[#cache#] CACHE_EVENT_JOBSET ###CHANGE %v", jobdata)
-						go store.changedCallback(CACHE_EVENT_JOBSET, jobbase)
-					}
-				}
-				found = true
-				break
-			}
+	for _, jobdata := range tempalloc.Jobs {
+		current, ret := origin[jobdata.JobId]
+		if ret && jobdata.Version <= current.Version { //版本未改变
+			continue
 		}
-		if !found { //加入新添加的任务
-			store.alloc.Jobs = append(store.alloc.Jobs, jobdata)
-			jobbase := store.tryGet(jobdata)
-			if jobbase != nil {
+		jobbase := store.tryGet(jobdata)
+		if jobbase != nil {
+			if ret {
+				logger.INFO("[#cache#] CACHE_EVENT_JOBSET ###CHANGE %v", jobdata)
+			} else {
 				logger.INFO("[#cache#] CACHE_EVENT_JOBSET ###CREATE %v", jobdata)
-				go store.changedCallback(CACHE_EVENT_JOBSET, jobbase)
 			}
+			go store.changedCallback(CACHE_EVENT_JOBSET, jobbase)
 		}
 	}
 	store.alloc = tempalloc
-	return nil
+}
+
+/*
+limitJobs 按优先级激活不超过maxJobs的任务, 超出的任务上报为拒绝
+1、已激活的任务优先, 避免任务在节点间迁移
+2、其余任务按分配表顺序
+store lock must be held.
+*/
+func (store *JobStore) limitJobs(jobs []*models.JobData) []*models.JobData {
+
+	rejected := make(map[string]*models.JobData)
+	if store.maxJobs <= 0 || len(jobs) <= store.maxJobs {
+		store.rejected = rejected
+		return jobs
+	}
+
+	active := make(map[string]bool, len(store.alloc.Jobs))
+	for _, jobdata := range store.alloc.Jobs {
+		active[jobdata.JobId] = true
+	}
+
+	ordered := make([]*models.JobData, 0, len(jobs))
+	for _, jobdata := range jobs {
+		if active[jobdata.JobId] {
+			ordered = append(ordered, jobdata)
+		}
+	}
+
+	for _, jobdata := range jobs {
+		if !active[jobdata.JobId] {
+			ordered = append(ordered, jobdata)
+		}
+	}
+
+	for _, jobdata := range ordered[store.maxJobs:] {
+		rejected[jobdata.JobId] = jobdata
+		if origin, ret := store.rejected[jobdata.JobId]; ret && origin.Version == jobdata.Version {
+			continue //已上报
+		}
+		jobget := &JobGet{JobId: jobdata.JobId, JobData: jobdata}
+		jobgeterror := &JobGetError{Code: ERROR_OVERLOAD, Error: fmt.Errorf("job rejected, node over capacity, maxjobs %d allocated %d", store.maxJobs, len(jobs))}
+		logger.WARN("[#cache#] CACHE_EVENT_JOBREJECT ###REJECT %v, %s", jobdata, jobgeterror.String())
+		go store.exceptionCallback(CACHE_EVENT_JOBREJECT, "", jobget, jobgeterror)
+	}
+	store.rejected = rejected
+	return ordered[:store.maxJobs]
+}
+
+//GetLoad is exported
+//return activated jobs count, rejected jobs count and max jobs.
+func (store *JobStore) GetLoad() (int, int, int) {
+
+	store.RLock()
+	defer store.RUnlock()
+	return len(store.alloc.Jobs), len(store.rejected), store.maxJobs
+}
+
+//saveAlloc persist applied alloc of this node, store lock must be held.
+func (store *JobStore) saveAlloc() {
+
+	data, err := models.JobsAllocEnCode(store.alloc)
+	if err != nil {
+		logger.ERROR("[#cache#] save alloc encode error, %s", err)
+		return
+	}
+
+	if err := writeFileAtomic(store.allocFile(), data, 0666); err != nil {
+		logger.ERROR("[#cache#] save alloc %s error, %s", store.allocFile(), err)
+	}
+}
+
+func (store *JobStore) allocFile() string {
+
+	return store.getter.Root + "/alloc.json"
+}
+
+//inUse return jobs allocated to this node and their jobfiles, which must not be evicted.
+func (store *JobStore) inUse() (map[string]bool, map[string]bool) {
+
+	jobids, files := map[string]bool{}, map[string]bool{}
+	store.RLock()
+	for _, jobdata := range store.alloc.Jobs {
+		jobids[jobdata.JobId] = true
+		if jobbase, ret := store.jobs[jobdata.JobId]; ret && jobbase.FileName != "" {
+			files[jobbase.FileName] = true
+		}
+	}
+	store.RUnlock()
+	return jobids, files
 }
 
 func (store *JobStore) tryGet(jobdata *models.JobData) *models.JobBase {
@@ -0,0 +1,102 @@
+package cache
+
+import "github.com/cloudtask/libtools/gounits/logger"
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	//单个job文件最多尝试的peer数
+	peerMaxTries = 3
+	//从单个peer拉取文件的超时时长
+	peerPullTimeout = 2 * time.Minute
+)
+
+var (
+	//ErrPeerShareDisabled is exported
+	ErrPeerShareDisabled = errors.New("peer share disabled.")
+	//ErrJobFileInvalid is exported
+	ErrJobFileInvalid = errors.New("job file name invalid.")
+)
+
+//SetPeers is exported
+//set agents api address of the same runtime, eg: http://192.168.2.10:8600
+func (getter *JobGetter) SetPeers(peers []string) {
+
+	getter.Lock()
+	getter.peers = peers
+	getter.Unlock()
+}
+
+//OpenJobFile is exported
+//open a cached jobfile to share with peers, only complete files under jobs directory are allowed.
+func (getter *JobGetter) OpenJobFile(filename string) (*os.File, error) {
+
+	if !getter.PeerShare {
+		return nil, ErrPeerShareDisabled
+	}
+
+	filename = strings.TrimSpace(filename)
+	if filename == "" || filename != filepath.Base(filename) || filename == "." || filename == ".." ||
+		strings.HasSuffix(filename, partSuffix) {
+		return nil, ErrJobFileInvalid
+	}
+	return os.Open(getter.Root + "/jobs/" + filename)
+}
+
+/*
+pullFromPeers 优先从同一runtime的其它agent拉取job文件
+1、job未携带sha256摘要时无法校验peer文件, 未配置api token时无法通过peer认证, 不从peer拉取
+2、下载完成后必须通过摘要(与签名)校验, 校验失败删除文件并尝试下一个peer
+3、全部peer失败返回false, 由调用方回退到文件包源
+*/
+func (getter *JobGetter) pullFromPeers(ctx context.Context, jobid string, jobfile string, filename string, pkg *PackageInfo) bool {
+
+	if !getter.PeerShare || getter.PeerToken == "" || pkg == nil || strings.TrimSpace(pkg.SHA256) == "" {
+		return false
+	}
+
+	sign := func(req *http.Request) {
+		req.Header.Set("Authorization", "Bearer "+getter.PeerToken)
+	}
+
+	getter.RLock()
+	peers := append([]string{}, getter.peers...)
+	getter.RUnlock()
+	rand.Shuffle(len(peers), func(i, j int) {
+		peers[i], peers[j] = peers[j], peers[i]
+	})
+
+	if len(peers) > peerMaxTries {
+		peers = peers[:peerMaxTries]
+	}
+
+	for _, peer := range peers {
+		remoteurl := strings.TrimSuffix(peer, "/") + "/cloudtask/v2/cache/files/" + url.PathEscape(filename)
+		peerctx, cancel := context.WithTimeout(ctx, peerPullTimeout)
+		err := getter.downloadFile(peerctx, jobid, jobfile, remoteurl, sign)
+		cancel()
+		if err != nil {
+			logger.WARN("[#cache#] getter pull jobfile %s from peer %s error, %s", filename, peer, err)
+			continue
+		}
+		if err := getter.verifier.Verify(jobfile, pkg); err != nil {
+			logger.WARN("[#cache#] getter verify jobfile %s from peer %s error, %s", filename, peer, err)
+			os.Remove(jobfile)
+			continue
+		}
+		logger.INFO("[#cache#] getter pull jobfile %s from peer %s", filename, peer)
+		getter.sources.servedBy(filename, "peer:"+peer)
+		return true
+	}
+	return false
+}
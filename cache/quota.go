@@ -0,0 +1,183 @@
+package cache
+
+import "github.com/cloudtask/libtools/gounits/logger"
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+DiskQuota is exported
+缓存磁盘配额
+1、MaxSize: 缓存目录总字节数上限, 0不限制
+2、MinFree: 缓存目录所在磁盘最少剩余字节数, 0不限制
+3、超过限制时按最近使用时间(LRU)淘汰未分配的job目录与未引用的job文件
+*/
+type DiskQuota struct {
+	sync.Mutex
+	Root    string
+	MaxSize int64
+	MinFree int64
+	blobs   *BlobStore
+}
+
+//evictItem is a cache path which can be evicted.
+type evictItem struct {
+	path   string
+	usedAt time.Time
+}
+
+//NewDiskQuota is exported
+func NewDiskQuota(configs *CacheConfigs, blobs *BlobStore) *DiskQuota {
+
+	return &DiskQuota{
+		Root:    configs.SaveDirectory,
+		MaxSize: configs.MaxSize,
+		MinFree: configs.MinFree,
+		blobs:   blobs,
+	}
+}
+
+//Enabled is exported
+func (quota *DiskQuota) Enabled() bool {
+
+	return quota.MaxSize > 0 || quota.MinFree > 0
+}
+
+/*
+Reclaim is exported
+检查配额, 超过时按LRU淘汰, 无法回收足够空间返回错误.
+jobids: 当前分配到本节点的job, files: 正在使用的job文件.
+缓存目录用量只遍历计算一次, 每次淘汰后减去实际释放的字节数(未被其它硬链接引用的文件).
+*/
+func (quota *DiskQuota) Reclaim(jobids map[string]bool, files map[string]bool) error {
+
+	if !quota.Enabled() {
+		return nil
+	}
+
+	quota.Lock()
+	defer quota.Unlock()
+	usage, free, err := quota.usage()
+	if err != nil {
+		return err
+	}
+
+	items := quota.evictItems(jobids, files)
+	for {
+		if (quota.MaxSize <= 0 || usage <= quota.MaxSize) && (quota.MinFree <= 0 || free >= quota.MinFree) {
+			return nil
+		}
+
+		if len(items) == 0 {
+			return fmt.Errorf("cache space exhausted, usage %d quota %d, free %d floor %d, nothing can be evicted", usage, quota.MaxSize, free, quota.MinFree)
+		}
+
+		item := items[0]
+		items = items[1:]
+		size := reclaimableSize(item.path)
+		if err := os.RemoveAll(item.path); err != nil {
+			logger.ERROR("[#cache#] quota evict %s error, %s", item.path, err)
+			continue
+		}
+		logger.INFO("[#cache#] quota evict %s, last used %s", item.path, item.usedAt.Format(time.RFC3339))
+		size += quota.blobs.Clean(quota.Root, 0) //释放已无引用的blob, blob锁保证不会删除正在解压或链接的blob
+		usage -= size
+		if free, err = diskFree(quota.Root); err != nil {
+			return err
+		}
+	}
+}
+
+/*
+Usage is exported
+返回缓存目录已用字节数(硬链接只计算一次)与所在磁盘剩余字节数
+*/
+func (quota *DiskQuota) Usage() (int64, int64, error) {
+
+	quota.Lock()
+	defer quota.Unlock()
+	return quota.usage()
+}
+
+//evictItems return unallocated job roots & unused job files, sorted by last used time asc.
+func (quota *DiskQuota) evictItems(jobids map[string]bool, files map[string]bool) []*evictItem {
+
+	items := []*evictItem{}
+	if fis, err := ioutil.ReadDir(quota.Root); err == nil {
+		for _, fic := range fis {
+			if !fic.IsDir() || jobids[fic.Name()] {
+				continue
+			}
+			jobroot := quota.Root + "/" + fic.Name()
+			info, err := os.Stat(jobroot + "/job.json")
+			if err != nil { //非job目录
+				continue
+			}
+			items = append(items, &evictItem{path: jobroot, usedAt: info.ModTime()})
+		}
+	}
+
+	if fis, err := ioutil.ReadDir(quota.Root + "/jobs"); err == nil {
+		for _, fic := range fis {
+			if fic.IsDir() || files[fic.Name()] || strings.HasSuffix(fic.Name(), partSuffix) {
+				continue
+			}
+			items = append(items, &evictItem{path: quota.Root + "/jobs/" + fic.Name(), usedAt: fic.ModTime()})
+		}
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].usedAt.Before(items[j].usedAt)
+	})
+	return items
+}
+
+//reclaimableSize return bytes freed when path removed, files still linked elsewhere are not counted.
+func reclaimableSize(path string) int64 {
+
+	var size int64
+	filepath.Walk(path, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		if _, ret := fileIdentity(info); !ret { //没有其它硬链接
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+//usage return cache used bytes(hardlinks counted once) and disk free bytes.
+func (quota *DiskQuota) usage() (int64, int64, error) {
+
+	var usage int64
+	seen := map[string]bool{}
+	filepath.Walk(quota.Root, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		if id, ret := fileIdentity(info); ret {
+			if seen[id] {
+				return nil
+			}
+			seen[id] = true
+		}
+		usage += info.Size()
+		return nil
+	})
+
+	free, err := diskFree(quota.Root)
+	if err != nil {
+		return 0, 0, err
+	}
+	return usage, free, nil
+}
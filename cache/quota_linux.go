@@ -0,0 +1,27 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+//diskFree return available bytes of the disk which path located.
+func diskFree(path string) (int64, error) {
+
+	stat := syscall.Statfs_t{}
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+//fileIdentity return device & inode of file, hardlinks have the same identity.
+func fileIdentity(info os.FileInfo) (string, bool) {
+
+	stat, ret := info.Sys().(*syscall.Stat_t)
+	if !ret || stat.Nlink <= 1 {
+		return "", false
+	}
+	return fmt.Sprintf("%d:%d", stat.Dev, stat.Ino), true
+}
@@ -0,0 +1,32 @@
+package cache
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var procGetDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+//diskFree return available bytes of the disk which path located.
+func diskFree(path string) (int64, error) {
+
+	ptr, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var available, total, free uint64
+	ret, _, err := procGetDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(ptr)),
+		uintptr(unsafe.Pointer(&available)), uintptr(unsafe.Pointer(&total)), uintptr(unsafe.Pointer(&free)))
+	if ret == 0 {
+		return 0, err
+	}
+	return int64(available), nil
+}
+
+//fileIdentity windows file info has no inode, hardlinks are counted repeatedly.
+func fileIdentity(info os.FileInfo) (string, bool) {
+
+	return "", false
+}
@@ -0,0 +1,230 @@
+package cache
+
+import "github.com/cloudtask/common/models"
+import "github.com/cloudtask/libtools/gounits/logger"
+
+import (
+	"errors"
+	"os"
+	"strings"
+)
+
+var (
+	//ErrJobNotAllocated is exported
+	ErrJobNotAllocated = errors.New("job not allocated to this node.")
+	//ErrJobRunning is exported
+	ErrJobRunning = errors.New("job is running.")
+	//ErrJobFilesMissing is exported
+	ErrJobFilesMissing = errors.New("job files missing.")
+	//ErrJobBlobMismatch is exported
+	ErrJobBlobMismatch = errors.New("job file does not match its extracted blob.")
+)
+
+/*
+JobPinner is exported
+重建job文件期间暂停该job的调度, 由driver实现.
+job正在执行时Hold返回false, 否则暂停调度直到job被重新设置(拉取完成)或删除.
+*/
+type JobPinner interface {
+	Hold(jobid string) bool
+}
+
+/*
+VerifyResult is exported
+缓存校验结果, 校验失败的job重新拉取修复(Repair)
+*/
+type VerifyResult struct {
+	JobId   string `json:"jobid"`
+	Version int    `json:"version"`
+	Check   bool   `json:"check"`
+	Repair  bool   `json:"repair"`
+	Error   string `json:"error,omitempty"`
+}
+
+/*
+Repull is exported
+强制重新拉取job, 取消正在进行的拉取, 不合并相同版本的请求.
+*/
+func (getter *JobGetter) Repull(jobdata *models.JobData) {
+
+	getter.Lock()
+	if jobget, ret := getter.gets[jobdata.JobId]; ret {
+		getter.cancelGet(jobget)
+	}
+	getter.Unlock()
+	getter.downloads.remove(jobdata.JobId)
+	getter.Get(jobdata)
+}
+
+/*
+Invalidate is exported
+删除job本地文件: 工作目录、job.json、package.json、job文件包与其解压的blob.
+工作目录中的文件硬链接自blob, 工作目录损坏时blob同样损坏, 必须一起删除.
+调用方需先取消该job的拉取.
+*/
+func (getter *JobGetter) Invalidate(jobbase *models.JobBase) {
+
+	jobroot := getter.Root + "/" + jobbase.JobId
+	if strings.TrimSpace(jobbase.FileName) != "" {
+		unlock := getter.lockFile(jobbase.FileName) //等待被取消的拉取退出
+		defer unlock()
+		jobfile := getter.Root + "/jobs/" + jobbase.FileName
+		if err := os.Remove(jobfile); err != nil && !os.IsNotExist(err) {
+			logger.ERROR("[#cache#] getter invalidate %s remove %s error, %s", jobbase.JobId, jobfile, err)
+		}
+	}
+
+	for _, digest := range getter.blobs.Referenced(jobbase.JobId, jobbase.FileCode) {
+		unlock := getter.lockFile(blobTree + "/" + digest)
+		if err := getter.blobs.Remove(digest); err != nil {
+			logger.ERROR("[#cache#] getter invalidate %s remove blob %s error, %s", jobbase.JobId, digest, err)
+		}
+		unlock()
+	}
+
+	os.Remove(jobroot + "/job.json")
+	os.Remove(jobroot + "/package.json")
+	getter.Lock()
+	delete(getter.packages, jobbase.JobId)
+	getter.Unlock()
+	if err := os.RemoveAll(jobroot + "/" + jobbase.FileCode); err != nil {
+		logger.ERROR("[#cache#] getter invalidate %s remove workdir error, %s", jobbase.JobId, err)
+	}
+	logger.INFO("[#cache#] getter invalidate %s filecode %s", jobbase.JobId, jobbase.FileCode)
+}
+
+/*
+Verify is exported
+校验job本地文件内容
+1、job文件需符合package.json保存的sha256与签名
+2、job文件的sha256需为job目录引用的blob摘要
+3、job目录中链接的blob文件需与blob清单一致
+*/
+func (getter *JobGetter) Verify(jobbase *models.JobBase) error {
+
+	if !getter.Check(jobbase) {
+		return ErrJobFilesMissing
+	}
+
+	digests := getter.blobs.Referenced(jobbase.JobId, jobbase.FileCode)
+	if strings.TrimSpace(jobbase.FileName) != "" {
+		getter.RLock()
+		pkg := getter.packages[jobbase.JobId]
+		getter.RUnlock()
+		if err := getter.verifier.Verify(getter.Root+"/jobs/"+jobbase.FileName, pkg); err != nil {
+			return err
+		}
+		digest, err := getter.blobs.Digest(getter.Root + "/jobs/" + jobbase.FileName)
+		if err != nil {
+			return err
+		}
+		matched := false
+		for _, value := range digests {
+			matched = matched || value == digest
+		}
+		if !matched {
+			return ErrJobBlobMismatch
+		}
+	}
+
+	jobdirectory := getter.Root + "/" + jobbase.JobId + "/" + jobbase.FileCode
+	for _, digest := range digests {
+		unlock := getter.lockFile(blobTree + "/" + digest)
+		err := getter.blobs.Verify(digest, jobdirectory)
+		unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+RepullJob is exported
+删除job本地文件并立即重新拉取, 拉取结果通过GetJobStatus查询.
+删除前通过pinner暂停job调度, job正在执行时返回ErrJobRunning, 拉取完成后job重新设置时恢复调度.
+*/
+func (store *JobStore) RepullJob(jobid string, pinner JobPinner) error {
+
+	store.RLock()
+	jobdata := store.allocJobData(jobid)
+	jobbase := store.jobs[jobid]
+	store.RUnlock()
+	if jobdata == nil {
+		return ErrJobNotAllocated
+	}
+
+	if pinner != nil && !pinner.Hold(jobid) {
+		return ErrJobRunning
+	}
+
+	logger.INFO("[#cache#] store repull job %s version %d", jobid, jobdata.Version)
+	store.getter.Remove(jobid)
+	if jobbase != nil {
+		store.getter.Invalidate(jobbase)
+	}
+	store.getter.Repull(jobdata)
+	return nil
+}
+
+/*
+VerifyJobs is exported
+校验全部已分配job的本地缓存内容, 校验在store锁外进行.
+1、文件缺失的job重新拉取, 不删除已有文件, 已在拉取中的job合并请求
+2、内容不一致的job与RepullJob相同删除后重新拉取, 正在执行的job不修复
+*/
+func (store *JobStore) VerifyJobs(pinner JobPinner) []*VerifyResult {
+
+	type verifyJob struct {
+		jobdata *models.JobData
+		jobbase *models.JobBase
+	}
+
+	jobs := []*verifyJob{}
+	store.RLock()
+	for _, jobdata := range store.alloc.Jobs {
+		jobs = append(jobs, &verifyJob{jobdata: jobdata, jobbase: store.jobs[jobdata.JobId]})
+	}
+	store.RUnlock()
+
+	results := []*VerifyResult{}
+	for _, job := range jobs {
+		result := &VerifyResult{JobId: job.jobdata.JobId, Version: job.jobdata.Version}
+		results = append(results, result)
+		err := ErrJobFilesMissing
+		if job.jobbase != nil {
+			err = store.getter.Verify(job.jobbase)
+		}
+		if err == nil {
+			result.Check = true
+			continue
+		}
+
+		result.Error = err.Error()
+		if err == ErrJobFilesMissing {
+			logger.WARN("[#cache#] verify %s files missing, repull.", job.jobdata.JobId)
+			store.getter.Get(job.jobdata)
+			result.Repair = true
+			continue
+		}
+
+		logger.WARN("[#cache#] verify %s content invalid, %s", job.jobdata.JobId, err.Error())
+		if err := store.RepullJob(job.jobdata.JobId, pinner); err != nil {
+			logger.WARN("[#cache#] verify %s repull skipped, %s", job.jobdata.JobId, err.Error())
+			continue
+		}
+		result.Repair = true
+	}
+	return results
+}
+
+//allocJobData return jobdata in alloc, store lock must be held.
+func (store *JobStore) allocJobData(jobid string) *models.JobData {
+
+	for _, jobdata := range store.alloc.Jobs {
+		if jobdata.JobId == jobid {
+			return jobdata
+		}
+	}
+	return nil
+}
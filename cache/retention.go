@@ -0,0 +1,130 @@
+package cache
+
+import "github.com/cloudtask/libtools/gounits/logger"
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+AllocRecord is exported
+job在本节点的分配记录
+Allocated: 当前是否分配在本节点
+AllocAt: 最后一次分配在本节点的时间(取消分配时更新为取消时间)
+*/
+type AllocRecord struct {
+	Allocated bool      `json:"allocated"`
+	AllocAt   time.Time `json:"allocat"`
+}
+
+/*
+AllocTracker is exported
+记录job最后分配在本节点的时间, 持久化到SaveDirectory/allocated.json.
+DumpCleaner根据记录删除超过保留时长未分配的job目录.
+*/
+type AllocTracker struct {
+	sync.Mutex
+	Path    string
+	records map[string]*AllocRecord
+}
+
+//NewAllocTracker is exported
+func NewAllocTracker(root string) *AllocTracker {
+
+	tracker := &AllocTracker{
+		Path:    root + "/allocated.json",
+		records: make(map[string]*AllocRecord),
+	}
+
+	if buf, err := ioutil.ReadFile(tracker.Path); err == nil {
+		if err := json.Unmarshal(buf, &tracker.records); err != nil {
+			logger.ERROR("[#cache#] alloc tracker read %s error, %s", tracker.Path, err)
+			tracker.records = make(map[string]*AllocRecord)
+		}
+	}
+	return tracker
+}
+
+/*
+SetAllocated is exported
+设置当前分配到本节点的job, 不在其中的job记录为取消分配.
+*/
+func (tracker *AllocTracker) SetAllocated(jobids []string) {
+
+	tracker.Lock()
+	defer tracker.Unlock()
+	now := time.Now()
+	allocated := map[string]bool{}
+	for _, jobid := range jobids {
+		allocated[jobid] = true
+		tracker.records[jobid] = &AllocRecord{Allocated: true, AllocAt: now}
+	}
+
+	for jobid, record := range tracker.records {
+		if record.Allocated && !allocated[jobid] {
+			record.Allocated = false
+			record.AllocAt = now
+		}
+	}
+	tracker.save()
+}
+
+/*
+Purge is exported
+删除超过保留时长未分配到本节点的job目录, 每次删除通过callback上报事件.
+*/
+func (tracker *AllocTracker) Purge(root string, retention time.Duration, callback JobCacheChangedHandlerFunc) {
+
+	tracker.Lock()
+	defer tracker.Unlock()
+	now := time.Now()
+	exists := map[string]bool{}
+	for _, jobbase := range readJobs(root) {
+		exists[jobbase.JobId] = true
+		record, ret := tracker.records[jobbase.JobId]
+		if !ret { //没有分配记录的目录, 从现在开始计算保留时长
+			tracker.records[jobbase.JobId] = &AllocRecord{Allocated: false, AllocAt: now}
+			continue
+		}
+
+		if record.Allocated || now.Sub(record.AllocAt) < retention {
+			continue
+		}
+
+		if err := os.RemoveAll(root + "/" + jobbase.JobId); err != nil {
+			logger.ERROR("[#cache#] dumpcleaner purge %s error:%s", jobbase.JobId, err.Error())
+			continue
+		}
+
+		delete(tracker.records, jobbase.JobId)
+		logger.INFO("[#cache#] CACHE_EVENT_JOBPURGE ###PURGE %s, last allocated %s", jobbase.JobId, record.AllocAt.Format(time.RFC3339))
+		if callback != nil {
+			callback(CACHE_EVENT_JOBPURGE, jobbase)
+		}
+	}
+
+	for jobid, record := range tracker.records {
+		if !record.Allocated && !exists[jobid] {
+			delete(tracker.records, jobid)
+		}
+	}
+	tracker.save()
+}
+
+//save write records to file, tracker lock must be held.
+func (tracker *AllocTracker) save() {
+
+	buf, err := json.Marshal(tracker.records)
+	if err != nil {
+		logger.ERROR("[#cache#] alloc tracker encode error, %s", err)
+		return
+	}
+
+	if err := writeFileAtomic(tracker.Path, buf, 0666); err != nil {
+		logger.ERROR("[#cache#] alloc tracker save %s error, %s", tracker.Path, err)
+	}
+}
@@ -0,0 +1,503 @@
+package cache
+
+import "github.com/cloudtask/libtools/gounits/logger"
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//HTTP镜像, URL为文件目录地址, 如: http://192.168.2.80:8091/api/file/default
+	SOURCE_HTTP = "http"
+	//本地或NFS挂载目录, 如: file:///mnt/packages
+	SOURCE_FILE = "file"
+	//S3兼容对象存储, URL为endpoint, 使用AWS Signature V4签名请求
+	SOURCE_S3 = "s3"
+)
+
+const (
+	//未配置sources时使用WebsiteHost的源名称
+	websiteSource = "website"
+	//连续失败次数达到阀值后标记为不可用
+	sourceFailThreshold = 3
+	//不可用源的最大隔离时长, 隔离结束后重新尝试
+	sourceMaxDownInterval = 10 * time.Minute
+	//S3签名算法
+	s3Algorithm = "AWS4-HMAC-SHA256"
+	//空内容sha256, GET请求的payload摘要
+	s3EmptyPayload = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+//ErrSourceNotFound is exported
+//the package is not found in a source, source is still healthy.
+var ErrSourceNotFound = errors.New("package not found in source.")
+
+/*
+SourceConfigs is exported
+job文件包源配置
+Type: http | file | s3, 为空时按URL协议识别
+S3源: URL为endpoint, 请求路径为 endpoint/Bucket/Prefix/FileName
+*/
+type SourceConfigs struct {
+	Name      string
+	Type      string
+	URL       string
+	Bucket    string
+	Prefix    string
+	Region    string
+	AccessKey string
+	SecretKey string
+}
+
+/*
+SourceHealth is exported
+源健康状态, 连续失败达到阀值后隔离一段时间(指数退避), 成功后恢复
+*/
+type SourceHealth struct {
+	Healthy     bool      `json:"healthy"`
+	Failures    int       `json:"failures"`
+	Served      int64     `json:"served"`
+	LastError   string    `json:"lasterror"`
+	LastSuccess time.Time `json:"lastsuccess"`
+	LastFailure time.Time `json:"lastfailure"`
+	DownUntil   time.Time `json:"downuntil"`
+}
+
+//SourceStatus is exported
+type SourceStatus struct {
+	Name   string       `json:"name"`
+	Type   string       `json:"type"`
+	URL    string       `json:"url"`
+	Health SourceHealth `json:"health"`
+}
+
+//ServedPackage is exported
+//the source which served a package.
+type ServedPackage struct {
+	FileName string    `json:"filename"`
+	Source   string    `json:"source"`
+	ServedAt time.Time `json:"servedat"`
+}
+
+//PackageSource is exported
+type PackageSource struct {
+	Name    string
+	Type    string
+	URL     string
+	configs *SourceConfigs
+	health  SourceHealth
+}
+
+/*
+SourceSet is exported
+按配置顺序排列的job文件包源, 拉取时优先使用健康的源, 失败时切换到下一个源.
+未配置源时使用WebsiteHost.
+*/
+type SourceSet struct {
+	sync.Mutex
+	sources []*PackageSource
+	website *PackageSource
+	served  map[string]*ServedPackage
+}
+
+//NewSourceSet is exported
+func NewSourceSet(configs []*SourceConfigs) *SourceSet {
+
+	set := &SourceSet{
+		sources: []*PackageSource{},
+		website: &PackageSource{Name: websiteSource, Type: SOURCE_HTTP, health: SourceHealth{Healthy: true}},
+		served:  make(map[string]*ServedPackage),
+	}
+
+	for i, conf := range configs {
+		source, err := newPackageSource(conf)
+		if err != nil {
+			logger.WARN("[#cache#] source %d %s invalid, %s", i, conf.URL, err)
+			continue
+		}
+		if source.Name == "" {
+			source.Name = fmt.Sprintf("%s-%d", source.Type, i)
+		}
+		set.sources = append(set.sources, source)
+	}
+	return set
+}
+
+func newPackageSource(conf *SourceConfigs) (*PackageSource, error) {
+
+	rawurl := strings.TrimSpace(conf.URL)
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	sourceType := strings.ToLower(strings.TrimSpace(conf.Type))
+	if sourceType == "" {
+		sourceType = SOURCE_HTTP
+		if u.Scheme == SOURCE_FILE {
+			sourceType = SOURCE_FILE
+		}
+	}
+
+	switch sourceType {
+	case SOURCE_HTTP:
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("http source url scheme invalid")
+		}
+	case SOURCE_FILE:
+		if u.Scheme != SOURCE_FILE || u.Path == "" {
+			return nil, fmt.Errorf("file source url invalid")
+		}
+	case SOURCE_S3:
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("s3 source endpoint invalid")
+		}
+		if strings.TrimSpace(conf.Bucket) == "" {
+			return nil, fmt.Errorf("s3 source bucket required")
+		}
+	default:
+		return nil, fmt.Errorf("source type %s not supported", sourceType)
+	}
+
+	return &PackageSource{
+		Name:    strings.TrimSpace(conf.Name),
+		Type:    sourceType,
+		URL:     strings.TrimSuffix(rawurl, "/"),
+		configs: conf,
+		health:  SourceHealth{Healthy: true},
+	}, nil
+}
+
+/*
+ordered 返回本次拉取尝试的源顺序
+健康的源按配置顺序在前, 隔离中的源按隔离结束时间在后(全部不可用时仍然尝试).
+*/
+func (set *SourceSet) ordered(websiteHost string) []*PackageSource {
+
+	set.Lock()
+	defer set.Unlock()
+	sources := set.sources
+	if len(sources) == 0 {
+		set.website.URL = strings.TrimSuffix(websiteHost, "/") + "/api/file/default"
+		sources = []*PackageSource{set.website}
+	}
+
+	now := time.Now()
+	healthy, down := []*PackageSource{}, []*PackageSource{}
+	for _, source := range sources {
+		if now.Before(source.health.DownUntil) {
+			down = append(down, source)
+		} else {
+			healthy = append(healthy, source)
+		}
+	}
+
+	sort.SliceStable(down, func(i, j int) bool {
+		return down[i].health.DownUntil.Before(down[j].health.DownUntil)
+	})
+	return append(healthy, down...)
+}
+
+func (set *SourceSet) success(source *PackageSource, filename string) {
+
+	set.Lock()
+	now := time.Now()
+	source.health.Healthy = true
+	source.health.Failures = 0
+	source.health.Served++
+	source.health.LastSuccess = now
+	source.health.DownUntil = time.Time{}
+	set.served[filename] = &ServedPackage{FileName: filename, Source: source.Name, ServedAt: now}
+	set.Unlock()
+}
+
+func (set *SourceSet) failure(source *PackageSource, err error) {
+
+	set.Lock()
+	now := time.Now()
+	source.health.Failures++
+	source.health.LastError = err.Error()
+	source.health.LastFailure = now
+	if source.health.Failures >= sourceFailThreshold {
+		down := retryBackoff(source.health.Failures-sourceFailThreshold+1, sourceMaxDownInterval)
+		source.health.Healthy = false
+		source.health.DownUntil = now.Add(down)
+		logger.WARN("[#cache#] source %s failed %d times, down until %s.", source.Name, source.health.Failures, source.health.DownUntil.Format(time.RFC3339))
+	}
+	set.Unlock()
+}
+
+//servedBy record a package served by other way(eg: peers).
+func (set *SourceSet) servedBy(filename string, name string) {
+
+	set.Lock()
+	set.served[filename] = &ServedPackage{FileName: filename, Source: name, ServedAt: time.Now()}
+	set.Unlock()
+}
+
+//Served is exported
+//return the source which served the package, not pulled return nil.
+func (set *SourceSet) Served(filename string) *ServedPackage {
+
+	set.Lock()
+	defer set.Unlock()
+	if served, ret := set.served[filename]; ret {
+		value := *served
+		return &value
+	}
+	return nil
+}
+
+//List is exported
+//return sources and their health.
+func (set *SourceSet) List() []*SourceStatus {
+
+	set.Lock()
+	defer set.Unlock()
+	sources := set.sources
+	if len(sources) == 0 {
+		sources = []*PackageSource{set.website}
+	}
+
+	status := []*SourceStatus{}
+	now := time.Now()
+	for _, source := range sources {
+		health := source.health
+		health.Healthy = !now.Before(health.DownUntil)
+		status = append(status, &SourceStatus{Name: source.Name, Type: source.Type, URL: source.URL, Health: health})
+	}
+	return status
+}
+
+/*
+pullFromSources 按顺序从源拉取job文件, 失败时切换到下一个源
+返回提供文件的源名称, 全部失败返回每个源的错误.
+*/
+func (getter *JobGetter) pullFromSources(ctx context.Context, jobid string, jobfile string, filename string) (string, error) {
+
+	errs := []string{}
+	for _, source := range getter.sources.ordered(getter.WebsiteHost) {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err.Error())
+			break
+		}
+		err := source.fetch(ctx, getter, jobid, jobfile, filename)
+		if err == nil {
+			getter.sources.success(source, filename)
+			logger.INFO("[#cache#] getter pull jobfile %s from source %s", filename, source.Name)
+			return source.Name, nil
+		}
+		if err != ErrSourceNotFound && ctx.Err() == nil { //文件不存在或拉取被取消不影响源的健康状态
+			getter.sources.failure(source, err)
+		}
+		logger.WARN("[#cache#] getter pull jobfile %s from source %s error, %s", filename, source.Name, err)
+		errs = append(errs, source.Name+": "+err.Error())
+	}
+	return "", errors.New(strings.Join(errs, "; "))
+}
+
+//fetch download filename from source to jobfile.
+func (source *PackageSource) fetch(ctx context.Context, getter *JobGetter, jobid string, jobfile string, filename string) error {
+
+	switch source.Type {
+	case SOURCE_FILE:
+		u, err := url.Parse(source.URL)
+		if err != nil {
+			return err
+		}
+		return getter.copyFile(ctx, jobid, jobfile, u.Path+"/"+filename)
+	case SOURCE_S3:
+		prefix := strings.Trim(source.configs.Prefix, "/")
+		object := source.configs.Bucket + "/" + filename
+		if prefix != "" {
+			object = source.configs.Bucket + "/" + prefix + "/" + filename
+		}
+		return getter.downloadFile(ctx, jobid, jobfile, source.URL+"/"+s3EscapePath(object), source.signS3)
+	}
+	return getter.downloadFile(ctx, jobid, jobfile, source.URL+"/"+filename, nil)
+}
+
+/*
+copyFile 从本地或NFS目录复制job文件
+先写入part文件, fsync后rename, 拉取取消时中止复制.
+*/
+func (getter *JobGetter) copyFile(ctx context.Context, jobid string, jobfile string, srcfile string) error {
+
+	sfd, err := os.Open(srcfile)
+	if os.IsNotExist(err) {
+		return ErrSourceNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	defer sfd.Close()
+	var total int64 = -1
+	if info, err := sfd.Stat(); err == nil {
+		total = info.Size()
+	}
+
+	partfile := jobfile + partSuffix
+	dfd, err := os.OpenFile(partfile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0777)
+	if err != nil {
+		return err
+	}
+
+	writer := &progressWriter{tracker: getter.downloads, jobid: jobid, filename: jobfile, downloaded: 0, total: total}
+	getter.downloads.set(jobid, jobfile, 0, total)
+	_, err = io.Copy(dfd, io.TeeReader(&contextReader{ctx: ctx, reader: sfd}, writer))
+	getter.downloads.set(jobid, jobfile, writer.downloaded, total)
+	if err == nil {
+		err = dfd.Sync()
+	}
+	dfd.Close()
+	if err != nil {
+		os.Remove(partfile)
+		return err
+	}
+	return os.Rename(partfile, jobfile)
+}
+
+//contextReader stop reading when context done.
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (reader *contextReader) Read(p []byte) (int, error) {
+
+	if err := reader.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return reader.reader.Read(p)
+}
+
+/*
+signS3 使用AWS Signature V4签名S3 GET请求
+签名头: host, range(续传时), x-amz-content-sha256, x-amz-date
+*/
+func (source *PackageSource) signS3(req *http.Request) {
+
+	now := time.Now().UTC()
+	amzdate := now.Format("20060102T150405Z")
+	req.Header.Set("x-amz-date", amzdate)
+	req.Header.Set("x-amz-content-sha256", s3EmptyPayload)
+	region := source.configs.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	req.Header.Set("Authorization", s3Authorization(req, amzdate, region, source.configs.AccessKey, source.configs.SecretKey))
+}
+
+func s3Authorization(req *http.Request, amzdate string, region string, accessKey string, secretKey string) string {
+
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": req.Header.Get("x-amz-content-sha256"),
+		"x-amz-date":           amzdate,
+	}
+	if value := req.Header.Get("Range"); value != "" {
+		headers["range"] = value
+	}
+
+	names := []string{}
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + strings.TrimSpace(headers[name]) + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		headers["x-amz-content-sha256"],
+	}, "\n")
+
+	date := amzdate[:8]
+	scope := date + "/" + region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := s3Algorithm + "\n" + amzdate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	return s3Algorithm + " Credential=" + accessKey + "/" + scope + ", SignedHeaders=" + signedHeaders + ", Signature=" + signature
+}
+
+func s3CanonicalQuery(query url.Values) string {
+
+	keys := []string{}
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := []string{}
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, s3Escape(key)+"="+s3Escape(value))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+//s3EscapePath escape object path, keep '/'.
+func s3EscapePath(path string) string {
+
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		parts[i] = s3Escape(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+//s3Escape uri encode except unreserved characters, as AWS required.
+func s3Escape(value string) string {
+
+	var builder strings.Builder
+	for _, c := range []byte(value) {
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' {
+			builder.WriteByte(c)
+		} else {
+			fmt.Fprintf(&builder, "%%%02X", c)
+		}
+	}
+	return builder.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,147 @@
+package cache
+
+import "github.com/cloudtask/common/models"
+
+import (
+	"time"
+)
+
+/*
+CacheStatus is exported
+缓存状态, 用于排查job未能启动的原因
+*/
+type CacheStatus struct {
+	AllocVersion int               `json:"allocversion"`
+	MaxJobs      int               `json:"maxjobs"`
+	Jobs         []*JobCacheStatus `json:"jobs"`
+	Rejected     []*models.JobData `json:"rejected"`
+	Gets         []*JobGetStatus   `json:"gets"`
+	Disk         *DiskUsage        `json:"disk"`
+}
+
+/*
+JobCacheStatus is exported
+分配到本节点的job缓存状态
+AllocVersion: 分配表中的版本, Version: 本地缓存的版本, Check: 本地文件与目录是否完整
+*/
+type JobCacheStatus struct {
+	JobId        string         `json:"jobid"`
+	AllocVersion int            `json:"allocversion"`
+	Cached       bool           `json:"cached"`
+	Version      int            `json:"version"`
+	FileName     string         `json:"filename"`
+	FileCode     string         `json:"filecode"`
+	Check        bool           `json:"check"`
+	Source       *ServedPackage `json:"source"`
+}
+
+/*
+JobGetStatus is exported
+getter中等待或正在拉取的job
+*/
+type JobGetStatus struct {
+	JobId     string    `json:"jobid"`
+	Version   int       `json:"version"`
+	State     string    `json:"state"`
+	ErrorCode ErrorCode `json:"errorcode"`
+	Error     string    `json:"error"`
+	Attempts  int       `json:"attempts"`
+	NextAt    time.Time `json:"nextat"`
+}
+
+/*
+DiskUsage is exported
+缓存目录磁盘使用, MaxSize与MinFree为0表示不限制
+*/
+type DiskUsage struct {
+	Usage   int64  `json:"usage"`
+	Free    int64  `json:"free"`
+	MaxSize int64  `json:"maxsize"`
+	MinFree int64  `json:"minfree"`
+	Error   string `json:"error,omitempty"`
+}
+
+/*
+JobStatus is exported
+单个job的缓存、拉取与下载状态
+*/
+type JobStatus struct {
+	JobCacheStatus
+	Get      *JobGetStatus     `json:"get"`
+	Download *DownloadProgress `json:"download"`
+}
+
+//GetStatus is exported
+//return jobgets which are waiting, pulling or waiting for retry.
+func (getter *JobGetter) GetStatus() []*JobGetStatus {
+
+	gets := []*JobGetStatus{}
+	getter.RLock()
+	for _, jobget := range getter.gets {
+		gets = append(gets, newJobGetStatus(jobget))
+	}
+	getter.RUnlock()
+	return gets
+}
+
+//GetJobStatus is exported
+//return a jobget status, not in getter return nil.
+func (getter *JobGetter) GetJobStatus(jobid string) *JobGetStatus {
+
+	getter.RLock()
+	defer getter.RUnlock()
+	if jobget, ret := getter.gets[jobid]; ret {
+		return newJobGetStatus(jobget)
+	}
+	return nil
+}
+
+//GetDownload is exported
+//return a job download progress, not downloading return nil.
+func (getter *JobGetter) GetDownload(jobid string) *DownloadProgress {
+
+	for _, progress := range getter.downloads.list() {
+		if progress.JobId == jobid {
+			return progress
+		}
+	}
+	return nil
+}
+
+//GetDiskUsage is exported
+func (getter *JobGetter) GetDiskUsage() *DiskUsage {
+
+	disk := &DiskUsage{
+		MaxSize: getter.quota.MaxSize,
+		MinFree: getter.quota.MinFree,
+	}
+
+	usage, free, err := getter.quota.Usage()
+	if err != nil {
+		disk.Error = err.Error()
+	}
+	disk.Usage = usage
+	disk.Free = free
+	return disk
+}
+
+//newJobGetStatus getter lock must be held.
+func newJobGetStatus(jobget *JobGet) *JobGetStatus {
+
+	status := &JobGetStatus{
+		JobId:    jobget.JobId,
+		State:    jobget.State.String(),
+		Attempts: jobget.Attempts,
+		NextAt:   jobget.NextAt,
+	}
+
+	if jobget.JobData != nil {
+		status.Version = jobget.JobData.Version
+	}
+
+	if jobget.Error != nil {
+		status.ErrorCode = jobget.Error.Code
+		status.Error = jobget.Error.String()
+	}
+	return status
+}
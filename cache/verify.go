@@ -0,0 +1,150 @@
+package cache
+
+import "github.com/cloudtask/common/models"
+import "github.com/cloudtask/libtools/gounits/logger"
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	//ErrPackageDigestMismatch is exported
+	ErrPackageDigestMismatch = errors.New("job file sha256 digest mismatch")
+	//ErrPackageSignatureMissing is exported
+	ErrPackageSignatureMissing = errors.New("job file signature missing")
+	//ErrPackageSignatureInvalid is exported
+	ErrPackageSignatureInvalid = errors.New("job file signature invalid")
+)
+
+/*
+PackageInfo is exported
+Job文件包校验信息, 由center返回jobbase时可选携带.
+SHA256: 文件包sha256摘要(hex)
+Signature: 对文件包sha256摘要(32字节原始值)的ed25519签名(base64)
+GitRepo: job文件来自git仓库时的仓库地址, 此时忽略FileName
+GitRef: git分支、tag或commit, 为空使用HEAD
+*/
+type PackageInfo struct {
+	SHA256    string `json:"filesha256"`
+	Signature string `json:"filesignature"`
+	GitRepo   string `json:"gitrepo"`
+	GitRef    string `json:"gitref"`
+}
+
+/*
+jobBaseResponse center jobbase返回数据, 在models.JobBase之外解析校验信息.
+*/
+type jobBaseResponse struct {
+	*models.JobBase
+	PackageInfo
+}
+
+/*
+PackageVerifier is exported
+Job文件包校验器
+1、jobbase携带sha256时校验文件摘要
+2、配置了可信公钥时要求文件摘要带有可信公钥的签名
+*/
+type PackageVerifier struct {
+	TrustedKeys []ed25519.PublicKey
+}
+
+//NewPackageVerifier is exported
+func NewPackageVerifier(trustedKeys []string) *PackageVerifier {
+
+	keys := []ed25519.PublicKey{}
+	for _, value := range trustedKeys {
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			logger.WARN("[#cache#] trusted key %s invalid, ignored.", value)
+			continue
+		}
+		keys = append(keys, ed25519.PublicKey(key))
+	}
+	return &PackageVerifier{TrustedKeys: keys}
+}
+
+//Verify is exported
+func (verifier *PackageVerifier) Verify(jobfile string, pkg *PackageInfo) error {
+
+	if pkg == nil {
+		pkg = &PackageInfo{}
+	}
+
+	if pkg.SHA256 == "" && len(verifier.TrustedKeys) == 0 {
+		return nil
+	}
+
+	digest, err := fileSHA256(jobfile)
+	if err != nil {
+		return err
+	}
+
+	if pkg.SHA256 != "" && !strings.EqualFold(hex.EncodeToString(digest), strings.TrimSpace(pkg.SHA256)) {
+		return fmt.Errorf("%s, expected %s got %x", ErrPackageDigestMismatch.Error(), pkg.SHA256, digest)
+	}
+
+	if len(verifier.TrustedKeys) == 0 {
+		return nil
+	}
+
+	if strings.TrimSpace(pkg.Signature) == "" {
+		return ErrPackageSignatureMissing
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(pkg.Signature))
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return ErrPackageSignatureInvalid
+	}
+
+	for _, key := range verifier.TrustedKeys {
+		if ed25519.Verify(key, digest, signature) {
+			return nil
+		}
+	}
+	return ErrPackageSignatureInvalid
+}
+
+func fileSHA256(fpath string) ([]byte, error) {
+
+	fd, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	defer fd.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, fd); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+//quarantineFile move a file which verify failed to quarantine directory, avoid it be used again.
+func quarantineFile(root string, fpath string) {
+
+	quarantine := root + "/quarantine"
+	if err := os.MkdirAll(quarantine, 0777); err != nil {
+		logger.ERROR("[#cache#] make quarantine directory error, %s", err)
+		os.Remove(fpath)
+		return
+	}
+
+	target := fmt.Sprintf("%s/%s.%d", quarantine, filepath.Base(fpath), time.Now().Unix())
+	if err := os.Rename(fpath, target); err != nil {
+		logger.ERROR("[#cache#] quarantine %s error, %s", fpath, err)
+		os.Remove(fpath)
+		return
+	}
+	logger.WARN("[#cache#] quarantine %s to %s", fpath, target)
+}
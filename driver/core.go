@@ -1,9 +1,11 @@
 package driver
 
 import "github.com/cloudtask/common/models"
+import "github.com/cloudtask/libtools/gounits/rand"
 
 import (
 	"fmt"
+	"os"
 	"time"
 )
 
@@ -13,12 +15,14 @@ type CoreHandler struct {
 
 type ExecCore struct {
 	JobId      string           //任务编号
+	RunId      string           //本次执行编号
 	WorkDir    string           //工作目录
 	Exit       ExitState        //退出状态
 	ExecAt     time.Time        //本次执行时间
 	NextAt     time.Time        //下次执行时间
 	Schedule   *models.Schedule //执行计划
 	ExecDriver *ExecDriver      //执行驱动
+	secrets    []string         //本次执行解析出的密钥值, 用于输出脱敏
 	handler    ICoreHandler     //回调handler
 }
 
@@ -43,6 +47,14 @@ func (core *ExecCore) GetExecTimes() float64 {
 	return ZERO_TICK
 }
 
+func (core *ExecCore) GetExitCode() int {
+
+	if core.ExecDriver != nil {
+		return core.ExecDriver.ExitCode
+	}
+	return -1
+}
+
 func (core *ExecCore) GetExecDriverPipeBuffer() ([]byte, []byte) {
 
 	if core.ExecDriver != nil {
@@ -51,24 +63,48 @@ func (core *ExecCore) GetExecDriverPipeBuffer() ([]byte, []byte) {
 	return nil, nil
 }
 
-func (core *ExecCore) Execute(seed time.Time, workdir string, cmd string, env []string) {
+func (core *ExecCore) MaskSecrets(data string) string {
+
+	return MaskSecrets(data, core.secrets)
+}
+
+func (core *ExecCore) Execute(seed time.Time, workdir string, cmd string, env []string, options *ExecOptions) {
 
 	if core.ExecDriver != nil {
 		return
 	}
 
-	core.Exit = EXIT_NORMAL //退出状态复位
-	core.WorkDir = workdir  //设置工作目录
-	core.ExecAt = seed      //设置执行时间
-	execdriver, err := NewExecDriver(workdir, cmd, env)
+	core.Exit = EXIT_NORMAL      //退出状态复位
+	core.RunId = rand.UUID(true) //生成执行编号
+	core.WorkDir = workdir       //设置工作目录
+	core.ExecAt = seed           //设置执行时间
+	core.secrets = nil
+	if options.Secrets != nil { //执行时解析密钥引用
+		resolved, values, err := options.Secrets.Resolve(env)
+		if err != nil {
+			go core.handler.OnCoreHandlerFunc(core, models.STATE_FAILED, fmt.Errorf("%s:%s", ErrExecuteException.Error(), err.Error()))
+			return
+		}
+		env = resolved
+		core.secrets = values
+	}
+
+	execdriver, err := NewExecDriver(workdir, cmd, env, options.Runs.Output(core.RunId))
 	if err != nil {
 		go core.handler.OnCoreHandlerFunc(core, models.STATE_FAILED, fmt.Errorf("%s:%s", ErrExecuteException.Error(), err.Error()))
 		return
 	}
 
+	execdriver.StopGrace = options.StopGrace
 	core.ExecDriver = execdriver
+	runid := core.RunId
 	start := make(chan bool)
+	saved := make(chan struct{})
 	go func() { //协程开启任务程序
+		defer func() { //等待进程信息持久化后再删除, 避免进程快速退出时残留
+			<-saved
+			options.Runs.Remove(runid)
+		}()
 		if err := core.ExecDriver.Start(start); err != nil { //start内部为start与wait，wait会阻塞，传入rc当start成功后可回调成功状态
 			switch core.Exit {
 			case EXIT_STOP: //通过stop命令退出，虽然强制关闭，但按流程退出.
@@ -86,11 +122,31 @@ func (core *ExecCore) Execute(seed time.Time, workdir string, cmd string, env []
 	}()
 	ret := <-start
 	if ret {
+		pid := execdriver.Command.Process.Pid
+		options.Runs.Save(&ActiveRun{ //持久化进程信息, agent重启后恢复
+			RunId:     runid,
+			JobId:     core.JobId,
+			Pid:       pid,
+			ProcStart: processStartTime(pid),
+			WorkDir:   workdir,
+			Cmd:       cmd,
+			ExecAt:    seed,
+			Secrets:   len(core.secrets) > 0,
+		})
 		go core.handler.OnCoreHandlerFunc(core, models.STATE_STARTED, nil)
 	}
+	close(saved)
 	close(start)
 }
 
+func (core *ExecCore) Signal(sig os.Signal) error {
+
+	if core.ExecDriver != nil {
+		return core.ExecDriver.Signal(sig)
+	}
+	return nil
+}
+
 func (core *ExecCore) Close(state ExitState) error {
 
 	if core.ExecDriver != nil {
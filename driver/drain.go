@@ -0,0 +1,239 @@
+package driver
+
+import "github.com/cloudtask/libtools/gounits/logger"
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+//默认drain等待时长
+const DEFAULT_DRAIN_TIMEOUT = time.Minute * 5
+
+var (
+	//agent退出时的drain不能恢复调度
+	ErrDrainShutdown = errors.New("the agent is shutting down, drain can not be resumed.")
+)
+
+type DrainState int
+
+const (
+	DRAIN_NONE  DrainState = iota //正常调度
+	DRAIN_DOING                   //停止调度新的执行, 等待正在执行的任务结束
+	DRAIN_DONE                    //drain完成, 剩余任务已停止
+)
+
+func (state DrainState) String() string {
+
+	switch state {
+	case DRAIN_NONE:
+		return "DRAIN_NONE"
+	case DRAIN_DOING:
+		return "DRAIN_DOING"
+	case DRAIN_DONE:
+		return "DRAIN_DONE"
+	}
+	return ""
+}
+
+/*
+DrainStatus is exported
+drain进度信息
+*/
+type DrainStatus struct {
+	State    DrainState `json:"-"`
+	StateStr string     `json:"state"`
+	StartAt  time.Time  `json:"startat"`
+	Deadline time.Time  `json:"deadline"`
+	Running  int        `json:"running"` //仍在执行的任务数
+	Stopped  int        `json:"stopped"` //超过deadline被强制停止的任务数
+}
+
+//GetDrainStatus is exported
+func (driver *Driver) GetDrainStatus() DrainStatus {
+
+	driver.RLock()
+	defer driver.RUnlock()
+	status := driver.drain
+	status.StateStr = status.State.String()
+	if status.State == DRAIN_DOING {
+		status.Running = driver.runningCount()
+	}
+	return status
+}
+
+/*
+Drain is exported
+停止调度新的执行, 最多等待DrainTimeout让正在执行的任务结束, 超时后停止剩余任务.
+已在drain中时等待其完成, 阻塞直到drain结束, 进度通过handler回调上报.
+agent退出时调用, 之后不能再恢复调度.
+*/
+func (driver *Driver) Drain() DrainStatus {
+
+	driver.Lock()
+	driver.shutdown = true //agent退出, 不允许恢复调度
+	began := driver.beginDrain()
+	drainCh := driver.drainCh
+	driver.Unlock()
+	if began {
+		return driver.WaitDrain()
+	}
+
+	<-drainCh
+	return driver.GetDrainStatus()
+}
+
+/*
+ResumeDrain is exported
+取消drain并恢复调度, 正在drain时不再停止剩余任务, 已被停止的任务等待下次调度.
+agent退出时的drain不能恢复.
+*/
+func (driver *Driver) ResumeDrain() error {
+
+	driver.Lock()
+	defer driver.Unlock()
+	if driver.shutdown {
+		return ErrDrainShutdown
+	}
+
+	if driver.drain.State == DRAIN_NONE {
+		return nil
+	}
+
+	if driver.drain.State == DRAIN_DOING {
+		close(driver.drainCh) //通知WaitDrain与Drain等待者
+	}
+	driver.drain = DrainStatus{State: DRAIN_NONE}
+	driver.drainCh = nil
+	logger.INFO("[#driver#] driver drain resumed.")
+	go driver.DrainHandleFunc(DrainStatus{State: DRAIN_NONE, StateStr: DRAIN_NONE.String()})
+	return nil
+}
+
+//BeginDrain is exported
+//set driver to draining, return false if driver already draining.
+func (driver *Driver) BeginDrain() bool {
+
+	driver.Lock()
+	defer driver.Unlock()
+	return driver.beginDrain()
+}
+
+//beginDrain driver lock must be held.
+func (driver *Driver) beginDrain() bool {
+
+	if driver.drain.State != DRAIN_NONE {
+		return false
+	}
+
+	now := time.Now()
+	driver.drain = DrainStatus{
+		State:    DRAIN_DOING,
+		StartAt:  now,
+		Deadline: now.Add(driver.options.DrainTimeout),
+	}
+	driver.drainCh = make(chan struct{})
+	logger.INFO("[#driver#] driver drain start, running %d, deadline %s.", driver.runningCount(), driver.drain.Deadline.String())
+	return true
+}
+
+/*
+WaitDrain is exported
+wait running jobs finished until drain deadline, then stop the rest.
+剩余任务在driver锁内标记为停止, 进程在锁外并行停止, 每个进程最多等待StopGrace, 期间不阻塞其它driver操作.
+drain被ResumeDrain取消时直接返回, 不停止任务.
+*/
+func (driver *Driver) WaitDrain() DrainStatus {
+
+	driver.RLock()
+	drainCh := driver.drainCh
+	driver.RUnlock()
+	status := driver.GetDrainStatus()
+	driver.DrainHandleFunc(status)
+	running := status.Running
+	reportAt := time.Now()
+	for running > 0 && time.Now().Before(status.Deadline) {
+		select {
+		case <-drainCh: //已恢复调度
+			return driver.GetDrainStatus()
+		case <-time.After(time.Second):
+		}
+		driver.RLock()
+		count := driver.runningCount()
+		driver.RUnlock()
+		if count != running || time.Since(reportAt) >= time.Second*30 {
+			logger.INFO("[#driver#] driver drain waiting, running %d.", count)
+			running = count
+			reportAt = time.Now()
+			driver.DrainHandleFunc(driver.GetDrainStatus())
+		}
+	}
+
+	driver.Lock()
+	if driver.drainCh != drainCh || driver.drain.State != DRAIN_DOING {
+		driver.Unlock()
+		return driver.GetDrainStatus()
+	}
+
+	stopped := 0
+	for jobid := range driver.orphans {
+		driver.killOrphan(jobid)
+		stopped++
+	}
+	type stopJob struct {
+		jobid       string
+		execdrivers []*ExecDriver
+	}
+	jobs := []*stopJob{}
+	for _, job := range driver.jobs {
+		if job.RunningCore() != nil { //包含已执行但尚未回调STARTED的任务
+			jobs = append(jobs, &stopJob{jobid: job.JobId, execdrivers: job.Stopping(EXIT_STOP)})
+		}
+	}
+	driver.Unlock()
+
+	wg := sync.WaitGroup{}
+	for _, job := range jobs {
+		logger.INFO("[#driver#] driver drain deadline, stop job %s.", job.jobid)
+		for _, execdriver := range job.execdrivers {
+			wg.Add(1)
+			go func(jobid string, execdriver *ExecDriver) {
+				defer wg.Done()
+				if err := execdriver.Stop(); err != nil {
+					logger.ERROR("[#driver#] driver drain stop job %s error, %s", jobid, err.Error())
+				}
+			}(job.jobid, execdriver)
+		}
+	}
+	wg.Wait()
+	stopped += len(jobs)
+
+	driver.Lock()
+	if driver.drainCh != drainCh || driver.drain.State != DRAIN_DOING { //停止期间已恢复调度
+		driver.Unlock()
+		return driver.GetDrainStatus()
+	}
+	driver.drain.State = DRAIN_DONE
+	driver.drain.Running = 0
+	driver.drain.Stopped = stopped
+	close(driver.drainCh)
+	driver.Unlock()
+
+	status = driver.GetDrainStatus()
+	logger.INFO("[#driver#] driver drain done, stopped %d.", stopped)
+	driver.DrainHandleFunc(status)
+	return status
+}
+
+//runningCount return running jobs & adopted orphans count, driver lock must be held.
+func (driver *Driver) runningCount() int {
+
+	count := len(driver.orphans)
+	for _, job := range driver.jobs {
+		if job.RunningCore() != nil {
+			count++
+		}
+	}
+	return count
+}
@@ -5,26 +5,111 @@ import "github.com/cloudtask/libtools/gounits/logger"
 
 import (
 	"fmt"
+	"os"
 	"strings"
 	"sync"
 	"time"
 )
 
+//DriverConfigs is exported
+type DriverConfigs struct {
+	Root             string
+	SecretsDirectory string
+	SecretsFile      string
+	TimeoutWarning   int
+	TimeoutSignal    string
+	StopGrace        string
+	OrphanPolicy     string
+	DrainTimeout     string
+}
+
+//ExecOptions is exported
+//driver级别的执行参数, 由DriverConfigs构造, 所有job共享.
+type ExecOptions struct {
+	Secrets      *SecretStore  //本地密钥存储, 执行时解析Env中的密钥引用
+	WarnPercent  int           //超时预警阀值(Timeout百分比), 0为不预警
+	WarnSignal   os.Signal     //超时预警发送给任务进程的信号, nil为不发送
+	StopGrace    time.Duration //停止任务时等待进程退出的时长, 超过后强制kill
+	Runs         *RunTracker   //正在执行任务进程的本地持久化
+	OrphanPolicy string        //agent重启后存活任务进程的处理策略
+	DrainTimeout time.Duration //drain时等待正在执行任务结束的最长时长
+}
+
+//NewExecOptions is exported
+func NewExecOptions(configs *DriverConfigs) *ExecOptions {
+
+	options := &ExecOptions{
+		Secrets:      NewSecretStore(configs.SecretsDirectory, configs.SecretsFile),
+		WarnPercent:  0,
+		WarnSignal:   nil,
+		StopGrace:    DEFAULT_STOP_GRACE,
+		Runs:         NewRunTracker(configs.Root),
+		OrphanPolicy: ORPHAN_POLICY_ADOPT,
+		DrainTimeout: DEFAULT_DRAIN_TIMEOUT,
+	}
+
+	if strings.ToLower(strings.TrimSpace(configs.OrphanPolicy)) == ORPHAN_POLICY_KILL {
+		options.OrphanPolicy = ORPHAN_POLICY_KILL
+	}
+
+	if configs.TimeoutWarning > 0 && configs.TimeoutWarning < 100 {
+		options.WarnPercent = configs.TimeoutWarning
+	}
+
+	if strings.TrimSpace(configs.TimeoutSignal) != "" {
+		sig, err := parseSignal(configs.TimeoutSignal)
+		if err != nil {
+			logger.WARN("[#driver#] timeout signal %s invalid, %s", configs.TimeoutSignal, err)
+		} else {
+			options.WarnSignal = sig
+		}
+	}
+
+	if configs.StopGrace != "" {
+		dur, err := time.ParseDuration(configs.StopGrace)
+		if err != nil || dur <= 0 {
+			logger.WARN("[#driver#] stop grace %s invalid, use default %s.", configs.StopGrace, DEFAULT_STOP_GRACE)
+		} else {
+			options.StopGrace = dur
+		}
+	}
+	if configs.DrainTimeout != "" {
+		dur, err := time.ParseDuration(configs.DrainTimeout)
+		if err != nil || dur < 0 {
+			logger.WARN("[#driver#] drain timeout %s invalid, use default %s.", configs.DrainTimeout, DEFAULT_DRAIN_TIMEOUT)
+		} else {
+			options.DrainTimeout = dur
+		}
+	}
+	return options
+}
+
 //Driver is exported
 type Driver struct {
 	sync.RWMutex
 	CoreHandler
-	Root    string
-	jobs    map[string]*Job
-	handler IDriverHandler
+	Root      string
+	jobs      map[string]*Job
+	orphans   map[string]*ActiveRun
+	holds     map[string]bool //文件重建中暂停调度的job
+	options   *ExecOptions
+	drain     DrainStatus
+	drainCh   chan struct{}
+	shutdown  bool //agent退出中
+	recovered bool //已恢复上次未结束的进程, 启动重试时不再重复恢复
+	handler   IDriverHandler
 }
 
 //NewDirver is exported
-func NewDirver(root string, handler IDriverHandler) *Driver {
+func NewDirver(configs *DriverConfigs, handler IDriverHandler) *Driver {
 
 	return &Driver{
-		Root:    root,
+		Root:    configs.Root,
 		jobs:    make(map[string]*Job, 0),
+		orphans: make(map[string]*ActiveRun, 0),
+		holds:   make(map[string]bool, 0),
+		options: NewExecOptions(configs),
+		drain:   DrainStatus{State: DRAIN_NONE},
 		handler: handler,
 	}
 }
@@ -33,6 +118,7 @@ func NewDirver(root string, handler IDriverHandler) *Driver {
 func (driver *Driver) Set(jobbase *models.JobBase) {
 
 	driver.Lock()
+	delete(driver.holds, jobbase.JobId) //文件已重新拉取, 恢复调度
 	if _, ret := driver.jobs[jobbase.JobId]; ret {
 		logger.INFO("[#driver#] driver jobChange %s.", jobbase.JobId)
 		driver.jobChange(jobbase)
@@ -47,6 +133,8 @@ func (driver *Driver) Set(jobbase *models.JobBase) {
 func (driver *Driver) Remove(jobid string) {
 
 	driver.Lock()
+	driver.killOrphan(jobid)
+	delete(driver.holds, jobid)
 	if job, ret := driver.jobs[jobid]; ret {
 		job.Close(EXIT_STOP)
 		delete(driver.jobs, jobid)
@@ -59,6 +147,9 @@ func (driver *Driver) Remove(jobid string) {
 func (driver *Driver) Clear() {
 
 	driver.Lock()
+	for jobid := range driver.orphans {
+		driver.killOrphan(jobid)
+	}
 	for _, job := range driver.jobs {
 		job.Close(EXIT_STOP)
 		delete(driver.jobs, job.JobId)
@@ -72,11 +163,26 @@ func (driver *Driver) Dispatch() {
 
 	driver.Lock()
 	for _, job := range driver.jobs {
+		if _, ret := driver.orphans[job.JobId]; ret { //已接管的进程还未退出, 不调度新的执行
+			continue
+		}
+		if driver.holds[job.JobId] && job.State == JOB_WAITING { //文件重建中, 不调度新的执行
+			continue
+		}
 		seed := time.Now()
 		switch job.State {
 		case JOB_WAITING:
-			job.Execute(seed, false) //调度正处于等待状态的job
+			if job.pending != nil { //结束回调时进程尚未清除的待切换版本
+				driver.applyPending(job.JobId, nil)
+			}
+			if driver.drain.State == DRAIN_NONE { //drain时不调度新的执行
+				job.Execute(seed, false) //调度正处于等待状态的job
+			}
 		case JOB_RUNNING:
+			if job.CheckWithWarning(seed) { //检查是否超过预警时间
+				context := driver.NewWarningContext(job, job.RunningCore(), ErrExecuteTimeoutWarning)
+				driver.TimeoutWarningHandleFunc(context)
+			}
 			job.CheckWithTimeout(seed) //检查是否超过执行时间
 		}
 	}
@@ -93,14 +199,23 @@ func (driver *Driver) Action(jobid string, action string) {
 		switch strings.ToLower(action) {
 		case "start":
 			{
-				if job.State == JOB_WAITING {
+				if _, ret := driver.orphans[jobid]; ret {
+					logger.INFO("[#driver#] driver job %s adopted process is running.", job.JobId)
+				} else if driver.drain.State != DRAIN_NONE {
+					logger.INFO("[#driver#] driver is draining, ignore start job %s.", job.JobId)
+				} else if driver.holds[jobid] {
+					logger.INFO("[#driver#] driver job %s files are rebuilding, ignore start.", job.JobId)
+				} else if job.State == JOB_WAITING {
 					logger.INFO("[#driver#] driver start job %s.", job.JobId)
 					job.Execute(time.Now(), true)
 				}
 			}
 		case "stop":
 			{
-				if job.State == JOB_RUNNING {
+				if _, ret := driver.orphans[jobid]; ret {
+					driver.killOrphan(jobid)
+					driver.applyPending(jobid, nil)
+				} else if job.State == JOB_RUNNING {
 					logger.INFO("[#driver#] driver stop job %s.", job.JobId)
 					job.Close(EXIT_STOP)
 				} else {
@@ -143,14 +258,86 @@ func (driver *Driver) jobChange(jobbase *models.JobBase) {
 
 	job := driver.jobs[jobbase.JobId]
 	if job != nil {
+		if _, ret := driver.orphans[job.JobId]; ret || job.RunningCore() != nil { //执行结束后再切换版本, STARTED回调前进程已在执行
+			job.SetPending(jobbase)
+			return
+		}
 		job.SetJob(jobbase, driver)
 		driver.jobSelect(job)
 	}
 }
 
+/*
+applyPending switch job to pending version after execute finished, driver lock must be held.
+finished为正在回调结束状态的core, 其ExecDriver在回调返回后才清除, 不视为执行中.
+*/
+func (driver *Driver) applyPending(jobid string, finished *ExecCore) {
+
+	job := driver.jobs[jobid]
+	if job == nil || job.pending == nil || job.executing(finished) {
+		return
+	}
+
+	if _, ret := driver.orphans[jobid]; ret {
+		return
+	}
+
+	jobbase := job.pending
+	logger.INFO("[#driver#] driver job %s switch version %d to %d.", jobid, job.Version, jobbase.Version)
+	job.SetJob(jobbase, driver)
+	driver.jobSelect(job)
+}
+
+//IsRunning is exported
+//return true if job is executing or adopted process is running.
+func (driver *Driver) IsRunning(jobid string) bool {
+
+	driver.RLock()
+	defer driver.RUnlock()
+	if _, ret := driver.orphans[jobid]; ret {
+		return true
+	}
+
+	job, ret := driver.jobs[jobid]
+	return ret && job.RunningCore() != nil
+}
+
+/*
+Hold is exported
+暂停job调度, 用于重建job文件(删除后重新拉取), job正在执行时返回false.
+job被重新设置(拉取完成)或删除后恢复调度.
+*/
+func (driver *Driver) Hold(jobid string) bool {
+
+	driver.Lock()
+	defer driver.Unlock()
+	if _, ret := driver.orphans[jobid]; ret {
+		return false
+	}
+
+	if job, ret := driver.jobs[jobid]; ret && job.RunningCore() != nil {
+		return false
+	}
+	driver.holds[jobid] = true
+	logger.INFO("[#driver#] driver hold job %s.", jobid)
+	return true
+}
+
+//GetJobVersions is exported
+//return job active & pending version, job not found return nil.
+func (driver *Driver) GetJobVersions(jobid string) *JobVersions {
+
+	driver.RLock()
+	defer driver.RUnlock()
+	if job, ret := driver.jobs[jobid]; ret {
+		return job.Versions()
+	}
+	return nil
+}
+
 func (driver *Driver) jobCreate(jobbase *models.JobBase) {
 
-	job := NewJob(driver.Root, jobbase, driver)
+	job := NewJob(driver.Root, jobbase, driver.options, driver)
 	if job != nil {
 		driver.jobSelect(job)
 		driver.jobs[jobbase.JobId] = job //加入到调度器
@@ -209,6 +396,9 @@ func (driver *Driver) OnCoreHandlerFunc(core *ExecCore, state int, err error) {
 		//回调执行状态(启动/停止)
 		context := driver.NewExecuteContext(job, core, nextat, err)
 		driver.ExecuteHandleFunc(state, context)
+		if state != models.STATE_STARTED {
+			driver.applyPending(job.JobId, core)
+		}
 	}
 	driver.Unlock()
 }
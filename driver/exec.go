@@ -4,9 +4,21 @@ import "github.com/cloudtask/libtools/gounits/logger"
 
 import (
 	"errors"
-	"io"
 	"io/ioutil"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+//停止任务时默认等待进程退出时长
+const DEFAULT_STOP_GRACE = time.Second * 5
+
+const (
+	//任务标准输出文件后缀
+	STDOUT_SUFFIX = ".stdout"
+	//任务错误输出文件后缀
+	STDERR_SUFFIX = ".stderr"
 )
 
 /*
@@ -19,6 +31,8 @@ var (
 	ErrExecuteException = errors.New("job execute exception")
 	//执行终止
 	ErrExecuteTerminal = errors.New("job execute terminal error")
+	//执行即将超时(超过预警阀值)
+	ErrExecuteTimeoutWarning = errors.New("the job has been executed for a long time and will exceed the timeout threshold soon.")
 )
 
 /*
@@ -29,18 +43,21 @@ type IExecDriver interface {
 	Start(start chan<- bool) error
 	//停止任务
 	Stop() error
-	//设置exec.cmd输入输出管道
-	SetCommandPipe() error
-	//读取exec.cmd管道数据
-	ReadCommandPipeBuffer(stdoutCh chan<- []byte, erroutCh chan<- []byte)
+	//向任务进程发送信号
+	Signal(sig os.Signal) error
+	//设置exec.cmd输出文件
+	SetCommandOutput(output string) error
+	//读取exec.cmd输出文件数据
+	ReadCommandOutput()
 }
 
 /*
 StdOutput 输出数据结构定义
 */
 type StdOutput struct {
-	Reader io.ReadCloser //输出读取对象(stdout或stderr)
-	Buffer []byte        //输出数据
+	Path   string   //输出文件路径
+	File   *os.File //输出文件, 进程启动后关闭
+	Buffer []byte   //输出数据
 }
 
 /*
@@ -48,62 +65,78 @@ ExecDriver 任务执行体
 负责任务执行的生命期和状态.
 */
 type ExecDriver struct {
-	Running   bool      //执行状态
-	Command   *exec.Cmd //执行对象
-	ExecTimes float64   //总执行时长
-	StdOut    StdOutput //标准输出
-	ErrOut    StdOutput //错误输出
+	Running   bool          //执行状态
+	Command   *exec.Cmd     //执行对象
+	ExecTimes float64       //总执行时长
+	ExitCode  int           //进程退出码, 未退出为-1
+	StopGrace time.Duration //停止时等待进程退出时长
+	StdOut    StdOutput     //标准输出
+	ErrOut    StdOutput     //错误输出
 }
 
 /*
-SetCommandPipe 设置command对象管道
-指定程序标准输出到StdOut.reader & ErrOut.reader
+SetCommandOutput 设置command对象输出文件
+程序标准输出写入output.stdout & output.stderr, 不使用管道,
+agent退出后任务进程仍可正常输出, 重启接管后可读取输出内容.
 设置失败返回error.
 */
-func (driver *ExecDriver) SetCommandPipe() error {
+func (driver *ExecDriver) SetCommandOutput(output string) error {
 
-	logger.INFO("[#driver#] set command pipe.")
-	//设置stdout管道输出
-	stdout, err := driver.Command.StdoutPipe()
+	logger.INFO("[#driver#] set command output %s.", output)
+	if err := os.MkdirAll(filepath.Dir(output), 0777); err != nil {
+		logger.ERROR("[#driver#] make output directory error:%s", err)
+		return err
+	}
+	//设置stdout输出文件
+	stdout, err := os.OpenFile(output+STDOUT_SUFFIX, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
 	if err != nil {
-		logger.ERROR("[#driver#] set stdoutpipe error:%s", err)
+		logger.ERROR("[#driver#] create stdout file error:%s", err)
 		return err
 	}
-	driver.StdOut.Reader = stdout
-	//设置errout管道输出
-	stderr, err := driver.Command.StderrPipe()
+	//设置errout输出文件
+	stderr, err := os.OpenFile(output+STDERR_SUFFIX, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
 	if err != nil {
-		logger.ERROR("[#driver#] set stderrpipe error:%s", err)
+		stdout.Close()
+		os.Remove(output + STDOUT_SUFFIX)
+		logger.ERROR("[#driver#] create stderr file error:%s", err)
 		return err
 	}
-	driver.ErrOut.Reader = stderr
+	driver.StdOut.Path, driver.StdOut.File = output+STDOUT_SUFFIX, stdout
+	driver.ErrOut.Path, driver.ErrOut.File = output+STDERR_SUFFIX, stderr
+	driver.Command.Stdout = stdout
+	driver.Command.Stderr = stderr
 	return nil
 }
 
+//closeCommandOutput close output files of agent, child process has inherited them after started.
+func (driver *ExecDriver) closeCommandOutput() {
+
+	for _, output := range []*StdOutput{&driver.StdOut, &driver.ErrOut} {
+		if output.File != nil {
+			output.File.Close()
+			output.File = nil
+		}
+	}
+}
+
 /*
-ReadCommandPipeBuffer 读取任务输出管道数据
+ReadCommandOutput 读取任务输出文件数据
 StdOut.Buffer:标准输出
 ErrOut.Buffer:错误输出
-分别开启携程读取管道数据，避免读取阻塞.
-若不开启携程，有种情况会出现读取stderr数据导致stdout读取阻塞.
+进程退出后读取, 输出文件在执行结束后由RunTracker删除.
 */
-func (driver *ExecDriver) ReadCommandPipeBuffer(stdoutCh chan<- []byte, erroutCh chan<- []byte) {
+func (driver *ExecDriver) ReadCommandOutput() {
 
-	logger.INFO("[#driver#] read command pipe.")
-	//携程读取stdout管道数据
-	go func() {
-		buf, err := ioutil.ReadAll(driver.StdOut.Reader)
-		if err != nil {
-			logger.ERROR("[#driver#] read stdoutpipe error:%s", err)
+	logger.INFO("[#driver#] read command output.")
+	driver.closeCommandOutput()
+	for _, output := range []*StdOutput{&driver.StdOut, &driver.ErrOut} {
+		if output.Path == "" {
+			continue
 		}
-		stdoutCh <- buf
-	}()
-	//携程读取errout管道数据
-	go func() {
-		buf, err := ioutil.ReadAll(driver.ErrOut.Reader)
+		buf, err := ioutil.ReadFile(output.Path)
 		if err != nil {
-			logger.ERROR("[#driver#] read stderrpipe error:%s", err)
+			logger.ERROR("[#driver#] read output %s error:%s", output.Path, err)
 		}
-		erroutCh <- buf
-	}()
+		output.Buffer = buf
+	}
 }
@@ -10,15 +10,16 @@ import (
 	"os/exec"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
-func NewExecDriver(name string, cmd string, env []string) (*ExecDriver, error) {
+func NewExecDriver(name string, cmd string, env []string, output string) (*ExecDriver, error) {
 
-	driver := &ExecDriver{Running: false, ExecTimes: ZERO_TICK}
+	driver := &ExecDriver{Running: false, ExecTimes: ZERO_TICK, ExitCode: -1, StopGrace: DEFAULT_STOP_GRACE}
 	driver.Command = exec.Command("/bin/bash", "-c", "cd "+name+" && "+cmd)
-	if err := driver.SetCommandPipe(); err != nil {
-		logger.ERROR("[#driver#] execdriver setcommandpipe error:%s", err)
+	if err := driver.SetCommandOutput(output); err != nil {
+		logger.ERROR("[#driver#] execdriver setcommandoutput error:%s", err)
 		return nil, err
 	}
 	driver.Command.Env = append(os.Environ(), env...)
@@ -29,25 +30,26 @@ func NewExecDriver(name string, cmd string, env []string) (*ExecDriver, error) {
 func (driver *ExecDriver) Start(start chan<- bool) error {
 
 	if driver.Command != nil {
+		driver.Command.SysProcAttr = &syscall.SysProcAttr{
+			Setpgid: true, //任务进程独立进程组, kill时包含所有子孙进程
+		}
 		logger.INFO("[#driver#] start execdriver")
-		start_t := time.Now() //记录开始执行时间
-		stdoutCh := make(chan []byte)
-		erroutCh := make(chan []byte)
-		driver.ReadCommandPipeBuffer(stdoutCh, erroutCh) //读取管道stdout、stderr输出数据
-		defer func() {
-			driver.StdOut.Buffer = <-stdoutCh
-			driver.ErrOut.Buffer = <-erroutCh
-			close(stdoutCh)
-			close(erroutCh)
-		}()
-		if err := driver.Command.Start(); err != nil {
+		start_t := time.Now()            //记录开始执行时间
+		defer driver.ReadCommandOutput() //退出后读取stdout、stderr输出文件
+		err := driver.Command.Start()
+		driver.closeCommandOutput() //任务进程已继承输出文件
+		if err != nil {
 			start <- driver.Running
 			logger.ERROR("[#driver#] start execdriver:%s", err)
 			return err
 		}
 		driver.Running = true
 		start <- driver.Running
-		if err := driver.Command.Wait(); err != nil {
+		err = driver.Command.Wait()
+		if driver.Command.ProcessState != nil {
+			driver.ExitCode = driver.Command.ProcessState.ExitCode()
+		}
+		if err != nil {
 			driver.Running = false
 			driver.ExecTimes = time.Now().Sub(start_t).Seconds() //计算执行时间差
 			logger.ERROR("[#driver#] wait execdriver:%s", err)
@@ -72,8 +74,8 @@ func (driver *ExecDriver) Stop() error {
 		if proc == nil {
 			return fmt.Errorf("stop job getProcess invalid.")
 		}
-		sendCtrlBreak(proc)                //发送退出消息
-		afc := time.After(time.Second * 5) //最多等待5s让任务进程退出
+		sendCtrlBreak(proc)                 //发送退出消息
+		afc := time.After(driver.StopGrace) //最多等待StopGrace让任务进程退出
 		done := false
 	NEW_TICK_DURATION:
 		ticker := time.NewTicker(time.Millisecond * 100)
@@ -87,7 +89,7 @@ func (driver *ExecDriver) Stop() error {
 				goto NEW_TICK_DURATION
 			case <-afc:
 				ticker.Stop()
-				if err := proc.Signal(os.Kill); err != nil {
+				if err := killProcess(driver.Command.Process.Pid); err != nil {
 					logger.ERROR("[#driver#] execdriver kill:%s", err)
 					return err
 				}
@@ -103,6 +105,42 @@ func (driver *ExecDriver) Stop() error {
 	return err
 }
 
+func (driver *ExecDriver) Signal(sig os.Signal) error {
+
+	if driver.Command != nil && driver.Command.Process != nil {
+		proc := getProcess(driver.Command.Process.Pid)
+		if proc == nil {
+			return fmt.Errorf("signal job getProcess invalid.")
+		}
+		if err := proc.Signal(sig); err != nil {
+			logger.ERROR("[#driver#] execdriver signal %s:%s", sig, err)
+			return err
+		}
+		logger.INFO("[#driver#] execdriver signal %s successed.(%d)", sig, proc.Pid)
+		return nil
+	}
+	return fmt.Errorf("signal execdriver command invalid.")
+}
+
+func parseSignal(name string) (os.Signal, error) {
+
+	switch strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(name)), "SIG") {
+	case "USR1":
+		return syscall.SIGUSR1, nil
+	case "USR2":
+		return syscall.SIGUSR2, nil
+	case "HUP":
+		return syscall.SIGHUP, nil
+	case "INT":
+		return syscall.SIGINT, nil
+	case "QUIT":
+		return syscall.SIGQUIT, nil
+	case "TERM":
+		return syscall.SIGTERM, nil
+	}
+	return nil, fmt.Errorf("unsupported signal %s", name)
+}
+
 func sendCtrlBreak(proc *os.Process) error {
 
 	if err := proc.Signal(os.Interrupt); err != nil {
@@ -7,11 +7,12 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 )
 
-func NewExecDriver(name string, cmd string, env []string) (*ExecDriver, error) {
+func NewExecDriver(name string, cmd string, env []string, output string) (*ExecDriver, error) {
 
 	filePath, err := filepath.Abs(name + "/" + cmd)
 	if err != nil {
@@ -19,10 +20,10 @@ func NewExecDriver(name string, cmd string, env []string) (*ExecDriver, error) {
 		return nil, err
 	}
 
-	driver := &ExecDriver{Running: false, ExecTimes: ZERO_TICK}
+	driver := &ExecDriver{Running: false, ExecTimes: ZERO_TICK, ExitCode: -1, StopGrace: DEFAULT_STOP_GRACE}
 	driver.Command = exec.Command("cmd", "/C", filePath)
-	if err := driver.SetCommandPipe(); err != nil {
-		logger.ERROR("[#driver#] execdriver setcommandpipe error:%s", err)
+	if err := driver.SetCommandOutput(output); err != nil {
+		logger.ERROR("[#driver#] execdriver setcommandoutput error:%s", err)
 		return nil, err
 	}
 	driver.Command.Env = append(os.Environ(), env...)
@@ -37,24 +38,22 @@ func (driver *ExecDriver) Start(start chan<- bool) error {
 			CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP,
 		}
 		logger.INFO("[#driver#] start execdriver")
-		start_t := time.Now() //记录开始执行时间
-		stdoutCh := make(chan []byte)
-		erroutCh := make(chan []byte)
-		driver.ReadCommandPipeBuffer(stdoutCh, erroutCh) //读取管道stdout、stderr输出数据
-		defer func() {
-			driver.StdOut.Buffer = <-stdoutCh
-			driver.ErrOut.Buffer = <-erroutCh
-			close(stdoutCh)
-			close(erroutCh)
-		}()
-		if err := driver.Command.Start(); err != nil {
+		start_t := time.Now()            //记录开始执行时间
+		defer driver.ReadCommandOutput() //退出后读取stdout、stderr输出文件
+		err := driver.Command.Start()
+		driver.closeCommandOutput() //任务进程已继承输出文件
+		if err != nil {
 			start <- driver.Running
 			logger.ERROR("[#driver#] start execdriver:%s", err)
 			return err
 		}
 		driver.Running = true
 		start <- driver.Running
-		if err := driver.Command.Wait(); err != nil {
+		err = driver.Command.Wait()
+		if driver.Command.ProcessState != nil {
+			driver.ExitCode = driver.Command.ProcessState.ExitCode()
+		}
+		if err != nil {
 			driver.Running = false
 			driver.ExecTimes = time.Now().Sub(start_t).Seconds() //计算执行时间差
 			logger.ERROR("[#driver#] wait execdriver:%s", err)
@@ -76,7 +75,7 @@ func (driver *ExecDriver) Stop() error {
 	logger.INFO("[#driver#] execdriver stop")
 	if driver.Command != nil && driver.Command.Process != nil {
 		sendCtrlBreak(driver.Command.Process.Pid) //发送退出消息
-		afc := time.After(time.Second * 5)        //最多等待5s让任务进程退出
+		afc := time.After(driver.StopGrace)       //最多等待StopGrace让任务进程退出
 		done := false
 	NEW_TICK_DURATION:
 		ticker := time.NewTicker(time.Millisecond * 100)
@@ -107,6 +106,26 @@ func (driver *ExecDriver) Stop() error {
 	return err
 }
 
+func (driver *ExecDriver) Signal(sig os.Signal) error {
+
+	if driver.Command != nil && driver.Command.Process != nil {
+		if sig != os.Interrupt {
+			return fmt.Errorf("windows platform does not support signal %s", sig)
+		}
+		return sendCtrlBreak(driver.Command.Process.Pid)
+	}
+	return fmt.Errorf("signal execdriver command invalid.")
+}
+
+func parseSignal(name string) (os.Signal, error) {
+
+	switch strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(name)), "SIG") {
+	case "INT", "BREAK":
+		return os.Interrupt, nil
+	}
+	return nil, fmt.Errorf("windows platform does not support signal %s", name)
+}
+
 func sendCtrlBreak(pid int) error {
 
 	dl, err := syscall.LoadDLL("kernel32.dll")
@@ -5,10 +5,13 @@ import (
 )
 
 /*
-  DriverContext上下文定义
+DriverContext上下文定义
 */
 type DriverContext struct {
 	Job       *Job
+	RunId     string
+	WorkDir   string //本次执行使用的工作目录, 执行期间切换版本时与Job.WorkDir不同
+	ExitCode  int
 	StdOut    string
 	ErrOut    string
 	ExecErr   string
@@ -18,23 +21,28 @@ type DriverContext struct {
 }
 
 /*
-  NewExecuteContext构造
+NewExecuteContext构造
 */
 func (driver *Driver) NewExecuteContext(job *Job, core *ExecCore, nextat time.Time, err error) *DriverContext {
 
 	context := &DriverContext{
-		Job:    job,
-		NextAt: nextat,
+		Job:      job,
+		ExitCode: -1,
+		NextAt:   nextat,
 	}
 
 	if err != nil {
 		context.ExecErr = err.Error()
 	}
 
-	if core != nil {
+	if core != nil { //输出内容中的密钥值脱敏
+		context.RunId = core.RunId
+		context.WorkDir = core.WorkDir
+		context.ExitCode = core.GetExitCode()
 		stdout, errout := core.GetExecDriverPipeBuffer()
-		context.StdOut = string(stdout)
-		context.ErrOut = string(errout)
+		context.StdOut = core.MaskSecrets(string(stdout))
+		context.ErrOut = core.MaskSecrets(string(errout))
+		context.ExecErr = core.MaskSecrets(context.ExecErr)
 		context.ExecAt = core.ExecAt
 		context.ExecTimes = core.GetExecTimes()
 	}
@@ -42,7 +50,7 @@ func (driver *Driver) NewExecuteContext(job *Job, core *ExecCore, nextat time.Ti
 }
 
 /*
-  NewSelectContext构造
+NewSelectContext构造
 */
 func (driver *Driver) NewSelectContext(job *Job, nextat time.Time) *DriverContext {
 
@@ -53,7 +61,7 @@ func (driver *Driver) NewSelectContext(job *Job, nextat time.Time) *DriverContex
 }
 
 /*
-  NewStopedContext构造
+NewStopedContext构造
 */
 func (driver *Driver) NewStopedContext(job *Job, execat time.Time, nextat time.Time, err error) *DriverContext {
 
@@ -70,7 +78,28 @@ func (driver *Driver) NewStopedContext(job *Job, execat time.Time, nextat time.T
 }
 
 /*
-  Driver回调handler定义
+NewWarningContext构造
+*/
+func (driver *Driver) NewWarningContext(job *Job, core *ExecCore, err error) *DriverContext {
+
+	context := &DriverContext{
+		Job: job,
+	}
+
+	if err != nil {
+		context.ExecErr = err.Error()
+	}
+
+	if core != nil {
+		context.RunId = core.RunId
+		context.ExecAt = core.ExecAt
+		context.ExecTimes = time.Now().Sub(core.ExecAt).Seconds()
+	}
+	return context
+}
+
+/*
+Driver回调handler定义
 */
 type IDriverHandler interface {
 	//DriverContext Code = ERR_SCHEDULE_EXECUTE
@@ -79,6 +108,10 @@ type IDriverHandler interface {
 	OnDriverSelectHandlerFunc(context *DriverContext)
 	//DriverContext Code = ERR_SCHEDULE_STOPED
 	OnDriverStopedHandlerFunc(state int, context *DriverContext)
+	//DriverContext Code = ERR_EXECUTE_TIMEOUTWARNING
+	OnDriverTimeoutWarningHandlerFunc(context *DriverContext)
+	//driver drain progress
+	OnDriverDrainHandlerFunc(status DrainStatus)
 }
 
 type DriverExecuteHandlerFunc func(state int, context *DriverContext)
@@ -99,6 +132,18 @@ func (fn DriverStopedHandlerFunc) OnDriverStopedHandlerFunc(state int, context *
 	fn(state, context)
 }
 
+type DriverTimeoutWarningHandlerFunc func(context *DriverContext)
+
+func (fn DriverTimeoutWarningHandlerFunc) OnDriverTimeoutWarningHandlerFunc(context *DriverContext) {
+	fn(context)
+}
+
+type DriverDrainHandlerFunc func(status DrainStatus)
+
+func (fn DriverDrainHandlerFunc) OnDriverDrainHandlerFunc(status DrainStatus) {
+	fn(status)
+}
+
 func (driver *Driver) ExecuteHandleFunc(state int, context *DriverContext) {
 
 	if context.Job != nil {
@@ -120,6 +165,18 @@ func (driver *Driver) StopedHandleFunc(state int, context *DriverContext) {
 	}
 }
 
+func (driver *Driver) TimeoutWarningHandleFunc(context *DriverContext) {
+
+	if context.Job != nil {
+		driver.handler.OnDriverTimeoutWarningHandlerFunc(context)
+	}
+}
+
+func (driver *Driver) DrainHandleFunc(status DrainStatus) {
+
+	driver.handler.OnDriverDrainHandlerFunc(status)
+}
+
 type ICoreHandler interface {
 	OnCoreHandlerFunc(core *ExecCore, state int, err error)
 }
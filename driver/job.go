@@ -29,36 +29,61 @@ action stop()    -----> job.core != nil -----> job.core -----> stop()
 */
 
 type Job struct {
-	JobId      string               //任务编号
-	Name       string               //任务名称
-	Root       string               //工作根目录
-	FileCode   string               //文件编码
-	WorkDir    string               //工作目录
-	Cmd        string               //执行命令
-	Env        []string             //环境变量
-	Timeout    int                  //执行超时(秒)
-	ExecMaxSec int64                //执行最长时长(时间戳：UNIX时间戳)
-	State      JobState             //执行状态
-	LastExecAt time.Time            //最后一次执行时间
-	LastError  error                //最后一次错误信息
-	cores      map[string]*ExecCore //每一个schedule对应一个core, cores为调度集合.
-	core       *ExecCore            //当job有schedule时，从调度集合中选择出来的有效core，为当前或即将调度的对象，并可计算nextat.
-	pcore      *ExecCore            //当job无schedule时，发起action可用tempcore执行.
-}
-
-func NewJob(root string, jobbase *models.JobBase, handler ICoreHandler) *Job {
+	JobId       string               //任务编号
+	Name        string               //任务名称
+	Root        string               //工作根目录
+	FileCode    string               //文件编码
+	Version     int                  //当前生效的版本
+	WorkDir     string               //工作目录
+	Cmd         string               //执行命令
+	Env         []string             //环境变量
+	Timeout     int                  //执行超时(秒)
+	ExecMaxSec  int64                //执行最长时长(时间戳：UNIX时间戳)
+	ExecWarnSec int64                //执行超时预警时间(时间戳：UNIX时间戳)
+	State       JobState             //执行状态
+	LastExecAt  time.Time            //最后一次执行时间
+	LastError   error                //最后一次错误信息
+	options     *ExecOptions         //driver执行参数
+	cores       map[string]*ExecCore //每一个schedule对应一个core, cores为调度集合.
+	core        *ExecCore            //当job有schedule时，从调度集合中选择出来的有效core，为当前或即将调度的对象，并可计算nextat.
+	pcore       *ExecCore            //当job无schedule时，发起action可用tempcore执行.
+	pending     *models.JobBase      //执行期间收到的新版本, 当前执行结束后再切换.
+}
+
+/*
+JobVersion is exported
+job版本信息, Active为当前生效版本, Pending为等待当前执行结束后切换的版本
+*/
+type JobVersion struct {
+	Version  int    `json:"version"`
+	FileCode string `json:"filecode"`
+	WorkDir  string `json:"workdir"`
+	Cmd      string `json:"cmd"`
+}
+
+//JobVersions is exported
+type JobVersions struct {
+	JobId   string      `json:"jobid"`
+	State   string      `json:"state"`
+	Active  *JobVersion `json:"active"`
+	Pending *JobVersion `json:"pending"`
+}
+
+func NewJob(root string, jobbase *models.JobBase, options *ExecOptions, handler ICoreHandler) *Job {
 
 	job := &Job{
 		JobId:      jobbase.JobId,
 		Name:       jobbase.JobName,
 		Root:       root,
 		FileCode:   jobbase.FileCode,
+		Version:    jobbase.Version,
 		WorkDir:    root + "/" + jobbase.JobId + "/" + jobbase.FileCode,
 		Cmd:        jobbase.Cmd,
 		Env:        jobbase.Env,
 		Timeout:    jobbase.Timeout,
 		ExecMaxSec: 0,
 		State:      JOB_WAITING,
+		options:    options,
 		cores:      make(map[string]*ExecCore, 0),
 		core:       nil,
 		pcore:      NewExecCore(jobbase.JobId, nil, handler),
@@ -75,8 +100,11 @@ func (job *Job) SetJob(jobbase *models.JobBase, handler ICoreHandler) {
 
 	job.Name = jobbase.JobName
 	job.FileCode = jobbase.FileCode
+	job.Version = jobbase.Version
+	job.pending = nil
 	job.WorkDir = job.Root + "/" + jobbase.JobId + "/" + jobbase.FileCode
 	job.Cmd = jobbase.Cmd
+	job.Env = jobbase.Env
 	job.Timeout = jobbase.Timeout
 	for scheduleid, core := range job.cores {
 		found := false
@@ -103,6 +131,43 @@ func (job *Job) SetJob(jobbase *models.JobBase, handler ICoreHandler) {
 	}
 }
 
+/*
+SetPending is exported
+job执行中时暂存新版本, 不修改WorkDir与Cmd, 避免影响正在执行的进程.
+多次变更只保留最新版本.
+*/
+func (job *Job) SetPending(jobbase *models.JobBase) {
+
+	job.pending = jobbase
+	logger.INFO("[#driver#] job %s running, version %d pending.", job.JobId, jobbase.Version)
+}
+
+//Versions is exported
+//return job active & pending version.
+func (job *Job) Versions() *JobVersions {
+
+	versions := &JobVersions{
+		JobId: job.JobId,
+		State: job.State.String(),
+		Active: &JobVersion{
+			Version:  job.Version,
+			FileCode: job.FileCode,
+			WorkDir:  job.WorkDir,
+			Cmd:      job.Cmd,
+		},
+	}
+
+	if job.pending != nil {
+		versions.Pending = &JobVersion{
+			Version:  job.pending.Version,
+			FileCode: job.pending.FileCode,
+			WorkDir:  job.Root + "/" + job.JobId + "/" + job.pending.FileCode,
+			Cmd:      job.pending.Cmd,
+		}
+	}
+	return versions
+}
+
 func (job *Job) Select() error {
 
 	logger.INFO("[#driver#] job %s select core...", job.JobId)
@@ -159,6 +224,52 @@ func (job *Job) Select() error {
 	return ErrAllScheduleInvalid
 }
 
+/*
+CheckWithWarning 检查是否超过预警时间
+首次超过时向任务进程发送预警信号(便于任务做checkpoint), 返回true由driver回调预警通知.
+*/
+func (job *Job) CheckWithWarning(seed time.Time) bool {
+
+	if job.ExecWarnSec > 0 && seed.Unix()-job.ExecWarnSec >= 0 {
+		job.ExecWarnSec = 0 //每次执行只预警一次
+		logger.INFO("[#driver#] job %s exec timeout warning.", job.JobId)
+		if job.options.WarnSignal != nil {
+			if core := job.RunningCore(); core != nil {
+				if err := core.Signal(job.options.WarnSignal); err != nil {
+					logger.ERROR("[#driver#] job %s send signal %s error, %s", job.JobId, job.options.WarnSignal, err)
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+//RunningCore is exported
+//return the core which is executing, no core executing return nil.
+func (job *Job) RunningCore() *ExecCore {
+
+	if job.core != nil && job.core.ExecDriver != nil {
+		return job.core
+	}
+
+	if job.pcore.ExecDriver != nil {
+		return job.pcore
+	}
+	return nil
+}
+
+//executing return true if a core except finished is executing.
+func (job *Job) executing(finished *ExecCore) bool {
+
+	for _, core := range []*ExecCore{job.core, job.pcore} {
+		if core != nil && core != finished && core.ExecDriver != nil {
+			return true
+		}
+	}
+	return false
+}
+
 func (job *Job) CheckWithTimeout(seed time.Time) {
 
 	if job.ExecMaxSec > 0 && seed.Unix()-job.ExecMaxSec > 0 {
@@ -173,19 +284,20 @@ func (job *Job) Execute(seed time.Time, force bool) {
 		if job.core != nil && seed.Sub(job.core.NextAt).Seconds() > ZERO_TICK {
 			logger.INFO("[#driver#] job %s !force execute %s", job.JobId, job.WorkDir)
 			calcMaxSec(job, seed)
-			job.core.Execute(seed, job.WorkDir, job.Cmd, job.Env)
+			job.core.Execute(seed, job.WorkDir, job.Cmd, job.Env, job.options)
 
 		}
 	} else { //强制执行, 用job.pcore对象
 		logger.INFO("[#driver#] job %s force execute %s", job.JobId, job.WorkDir)
 		calcMaxSec(job, seed)
-		job.pcore.Execute(seed, job.WorkDir, job.Cmd, job.Env)
+		job.pcore.Execute(seed, job.WorkDir, job.Cmd, job.Env, job.options)
 	}
 }
 
 func (job *Job) Close(state ExitState) {
 
 	job.ExecMaxSec = 0
+	job.ExecWarnSec = 0
 	if job.core != nil {
 		job.core.Close(state)
 	}
@@ -193,10 +305,33 @@ func (job *Job) Close(state ExitState) {
 	logger.INFO("[#driver#] job %s execute close, state %s.", job.JobId, state.String())
 }
 
+/*
+Stopping 标记job的执行为停止状态并返回执行中的ExecDriver, driver锁内调用.
+返回的ExecDriver由调用方在锁外Stop, 避免等待进程退出时持有driver锁.
+*/
+func (job *Job) Stopping(state ExitState) []*ExecDriver {
+
+	job.ExecMaxSec = 0
+	job.ExecWarnSec = 0
+	execdrivers := []*ExecDriver{}
+	for _, core := range []*ExecCore{job.core, job.pcore} {
+		if core != nil && core.ExecDriver != nil {
+			core.Exit = state
+			execdrivers = append(execdrivers, core.ExecDriver)
+		}
+	}
+	return execdrivers
+}
+
 func calcMaxSec(job *Job, seed time.Time) {
 
 	job.ExecMaxSec = 0
+	job.ExecWarnSec = 0
 	if job.Timeout > 0 {
 		job.ExecMaxSec = seed.Unix() + (int64)(job.Timeout)
+		if job.options.WarnPercent > 0 {
+			offset := ((int64)(job.Timeout)*(int64)(job.options.WarnPercent) + 99) / 100 //向上取整, 短超时不会在首次调度时预警
+			job.ExecWarnSec = seed.Unix() + offset
+		}
 	}
 }
@@ -0,0 +1,309 @@
+package driver
+
+import "github.com/cloudtask/common/models"
+import "github.com/cloudtask/libtools/gounits/logger"
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//孤儿进程处理策略: 接管监控直到退出
+	ORPHAN_POLICY_ADOPT = "adopt"
+	//孤儿进程处理策略: 直接kill
+	ORPHAN_POLICY_KILL = "kill"
+)
+
+var (
+	//agent重启时任务进程已退出, 执行结果丢失
+	ErrOrphanLost = errors.New("the job process exited while the agent was down, execute result lost.")
+	//agent重启后接管的任务进程已退出, 无法获取退出码
+	ErrOrphanAdoptExited = errors.New("the adopted job process exited after the agent restarted, exit code unavailable.")
+	//agent重启后kill掉未跟踪的任务进程
+	ErrOrphanKilled = errors.New("the untracked job process was killed after the agent restarted.")
+)
+
+/*
+ActiveRun is exported
+正在执行的任务进程信息, 持久化到本地用于agent重启后恢复.
+*/
+type ActiveRun struct {
+	RunId     string    `json:"runid"`
+	JobId     string    `json:"jobid"`
+	Pid       int       `json:"pid"`
+	ProcStart string    `json:"procstart"` //进程启动标识, 用于识别pid被复用
+	WorkDir   string    `json:"workdir"`
+	Cmd       string    `json:"cmd"`
+	ExecAt    time.Time `json:"execat"`
+	Secrets   bool      `json:"secrets"` //执行时解析了密钥, 重启后无法对输出脱敏
+}
+
+/*
+RunTracker is exported
+正在执行任务进程的本地持久化, 每个run一个文件, 执行结束后删除.
+任务进程的输出写入同目录下的<runid>.stdout与<runid>.stderr, 与run文件一起删除.
+*/
+type RunTracker struct {
+	sync.Mutex
+	Root string
+}
+
+//NewRunTracker is exported
+func NewRunTracker(root string) *RunTracker {
+
+	return &RunTracker{
+		Root: root + "/active",
+	}
+}
+
+//Save is exported
+func (tracker *RunTracker) Save(run *ActiveRun) {
+
+	tracker.Lock()
+	defer tracker.Unlock()
+	if err := os.MkdirAll(tracker.Root, 0777); err != nil {
+		logger.ERROR("[#driver#] tracker make root error, %s", err)
+		return
+	}
+
+	buf, err := json.Marshal(run)
+	if err != nil {
+		logger.ERROR("[#driver#] tracker encode run %s error, %s", run.RunId, err)
+		return
+	}
+
+	if err := writeFileAtomic(tracker.Root+"/"+run.RunId+".json", buf, 0666); err != nil {
+		logger.ERROR("[#driver#] tracker save run %s error, %s", run.RunId, err)
+	}
+}
+
+//Output is exported
+//return the output path prefix of a run.
+func (tracker *RunTracker) Output(runid string) string {
+
+	return tracker.Root + "/" + runid
+}
+
+//ReadOutput is exported
+//read stdout and stderr of a run.
+func (tracker *RunTracker) ReadOutput(runid string) ([]byte, []byte) {
+
+	stdout, _ := ioutil.ReadFile(tracker.Output(runid) + STDOUT_SUFFIX)
+	stderr, _ := ioutil.ReadFile(tracker.Output(runid) + STDERR_SUFFIX)
+	return stdout, stderr
+}
+
+//Remove is exported
+func (tracker *RunTracker) Remove(runid string) {
+
+	tracker.Lock()
+	defer tracker.Unlock()
+	for _, suffix := range []string{".json", STDOUT_SUFFIX, STDERR_SUFFIX} {
+		if err := os.Remove(tracker.Root + "/" + runid + suffix); err != nil && !os.IsNotExist(err) {
+			logger.ERROR("[#driver#] tracker remove run %s error, %s", runid, err)
+		}
+	}
+}
+
+//Load is exported
+func (tracker *RunTracker) Load() []*ActiveRun {
+
+	tracker.Lock()
+	defer tracker.Unlock()
+	runs := []*ActiveRun{}
+	fis, err := ioutil.ReadDir(tracker.Root)
+	if err != nil {
+		return runs
+	}
+
+	outputs := []string{}
+	for _, fi := range fis {
+		if fi.IsDir() {
+			continue
+		}
+		if !strings.HasSuffix(fi.Name(), ".json") {
+			outputs = append(outputs, fi.Name())
+			continue
+		}
+		fpath := filepath.Join(tracker.Root, fi.Name())
+		buf, err := ioutil.ReadFile(fpath)
+		if err != nil {
+			continue
+		}
+		run := &ActiveRun{}
+		if err := json.Unmarshal(buf, run); err != nil || run.RunId == "" {
+			logger.ERROR("[#driver#] tracker read %s invalid, removed.", fi.Name())
+			os.Remove(fpath)
+			continue
+		}
+		runs = append(runs, run)
+	}
+
+	for _, name := range outputs { //清理没有run文件的输出文件与写入中断的临时文件
+		runid := strings.TrimSuffix(strings.TrimSuffix(name, STDOUT_SUFFIX), STDERR_SUFFIX)
+		if _, err := os.Stat(filepath.Join(tracker.Root, runid+".json")); os.IsNotExist(err) {
+			os.Remove(filepath.Join(tracker.Root, name))
+		}
+	}
+	return runs
+}
+
+/*
+writeFileAtomic 原子写入文件
+先写入临时文件并fsync, 再rename为目标文件, 崩溃时不会留下写入一半的文件.
+*/
+func writeFileAtomic(fpath string, data []byte, perm os.FileMode) error {
+
+	temp := fpath + ".tmp"
+	fd, err := os.OpenFile(temp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err = fd.Write(data); err == nil {
+		err = fd.Sync()
+	}
+	fd.Close()
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+
+	if err := os.Rename(temp, fpath); err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return syncDirectory(filepath.Dir(fpath))
+}
+
+/*
+Recover is exported
+agent启动时恢复上次未结束的任务进程.
+进程已退出: 上报执行结果丢失.
+进程仍存活: 根据策略接管监控直到退出, 或直接kill, 并上报结果.
+被接管的job在进程退出前不会被调度新的执行.
+启动失败重试时可能被多次调用, 只在首次调用时恢复.
+*/
+func (driver *Driver) Recover() {
+
+	driver.Lock()
+	recovered := driver.recovered
+	driver.recovered = true
+	driver.Unlock()
+	if recovered {
+		logger.INFO("[#driver#] driver active runs already recovered.")
+		return
+	}
+
+	runs := driver.options.Runs.Load()
+	logger.INFO("[#driver#] driver recover %d active runs, policy %s.", len(runs), driver.options.OrphanPolicy)
+	for _, run := range runs {
+		if !processAlive(run.Pid, run.ProcStart) {
+			logger.WARN("[#driver#] driver recover job %s run %s pid %d lost.", run.JobId, run.RunId, run.Pid)
+			driver.orphanExited(run, models.STATE_FAILED, ErrOrphanLost)
+			continue
+		}
+
+		if driver.options.OrphanPolicy == ORPHAN_POLICY_KILL {
+			logger.WARN("[#driver#] driver recover job %s run %s pid %d kill.", run.JobId, run.RunId, run.Pid)
+			if err := killProcess(run.Pid); err != nil {
+				logger.ERROR("[#driver#] driver recover kill pid %d error, %s", run.Pid, err)
+			}
+			driver.orphanExited(run, models.STATE_FAILED, ErrOrphanKilled)
+			continue
+		}
+
+		logger.INFO("[#driver#] driver recover job %s run %s pid %d adopt.", run.JobId, run.RunId, run.Pid)
+		driver.Lock()
+		driver.orphans[run.JobId] = run
+		driver.Unlock()
+		context := driver.newOrphanContext(run, nil)
+		driver.ExecuteHandleFunc(models.STATE_STARTED, context)
+		go driver.watchOrphan(run)
+	}
+}
+
+//watchOrphan wait adopted orphan process exited.
+func (driver *Driver) watchOrphan(run *ActiveRun) {
+
+	for {
+		time.Sleep(time.Second)
+		if !processAlive(run.Pid, run.ProcStart) {
+			break
+		}
+		driver.RLock()
+		_, ret := driver.orphans[run.JobId]
+		driver.RUnlock()
+		if !ret { //已被kill
+			return
+		}
+	}
+
+	driver.Lock()
+	_, ret := driver.orphans[run.JobId]
+	delete(driver.orphans, run.JobId)
+	driver.applyPending(run.JobId, nil)
+	driver.Unlock()
+	if ret {
+		logger.INFO("[#driver#] driver adopted job %s run %s pid %d exited.", run.JobId, run.RunId, run.Pid)
+		driver.orphanExited(run, models.STATE_STOPED, ErrOrphanAdoptExited)
+	}
+}
+
+//killOrphan kill adopted orphan process, driver lock must be held.
+func (driver *Driver) killOrphan(jobid string) {
+
+	if run, ret := driver.orphans[jobid]; ret {
+		delete(driver.orphans, jobid)
+		logger.INFO("[#driver#] driver kill adopted job %s run %s pid %d.", run.JobId, run.RunId, run.Pid)
+		if err := killProcess(run.Pid); err != nil {
+			logger.ERROR("[#driver#] driver kill pid %d error, %s", run.Pid, err)
+		}
+		go driver.orphanExited(run, models.STATE_STOPED, nil)
+	}
+}
+
+func (driver *Driver) orphanExited(run *ActiveRun, state int, err error) {
+
+	context := driver.newOrphanContext(run, err)
+	if run.Secrets { //密钥值未持久化, 无法脱敏, 不上报输出
+		logger.WARN("[#driver#] driver orphan job %s run %s output withheld, secrets can not be masked.", run.JobId, run.RunId)
+	} else {
+		stdout, errout := driver.options.Runs.ReadOutput(run.RunId)
+		context.StdOut = string(stdout)
+		context.ErrOut = string(errout)
+	}
+	driver.options.Runs.Remove(run.RunId)
+	driver.ExecuteHandleFunc(state, context)
+}
+
+func (driver *Driver) newOrphanContext(run *ActiveRun, err error) *DriverContext {
+
+	job := &Job{
+		JobId:   run.JobId,
+		Root:    driver.Root,
+		WorkDir: run.WorkDir,
+		Cmd:     run.Cmd,
+	}
+
+	context := &DriverContext{
+		Job:       job,
+		RunId:     run.RunId,
+		WorkDir:   run.WorkDir,
+		ExitCode:  -1,
+		ExecAt:    run.ExecAt,
+		ExecTimes: time.Now().Sub(run.ExecAt).Seconds(),
+	}
+
+	if err != nil {
+		context.ExecErr = err.Error()
+	}
+	return context
+}
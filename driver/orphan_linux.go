@@ -0,0 +1,71 @@
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+//processStartTime return process starttime(clock ticks since boot) from /proc/<pid>/stat.
+func processStartTime(pid int) string {
+
+	buf, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return ""
+	}
+
+	data := string(buf)
+	index := strings.LastIndex(data, ")") //comm字段可能包含空格
+	if index < 0 {
+		return ""
+	}
+
+	fields := strings.Fields(data[index+1:])
+	if len(fields) < 20 {
+		return ""
+	}
+	return fields[19] //starttime为第22个字段
+}
+
+func processAlive(pid int, procstart string) bool {
+
+	if pid <= 0 {
+		return false
+	}
+
+	if err := syscall.Kill(pid, 0); err != nil && err != syscall.EPERM {
+		return false
+	}
+
+	if procstart != "" && processStartTime(pid) != procstart { //pid已被其它进程复用
+		return false
+	}
+	return true
+}
+
+//killProcess kill the process group of job, bash started with Setpgid is the group leader.
+func killProcess(pid int) error {
+
+	if err := syscall.Kill(-pid, syscall.SIGKILL); err == nil {
+		return nil
+	}
+
+	if proc := getProcess(pid); proc != nil && proc.Pid > 0 { //未设置进程组的任务进程, 先kill bash子进程
+		proc.Kill()
+	}
+	return syscall.Kill(pid, syscall.SIGKILL)
+}
+
+//syncDirectory fsync directory entries, make renames durable.
+func syncDirectory(path string) error {
+
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer fd.Close()
+	return fd.Sync()
+}
@@ -0,0 +1,47 @@
+package driver
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+)
+
+const processQueryLimitedInformation = 0x1000
+
+const stillActive = 259
+
+//processStartTime windows platform does not verify process starttime.
+func processStartTime(pid int) string {
+
+	return ""
+}
+
+func processAlive(pid int, procstart string) bool {
+
+	if pid <= 0 {
+		return false
+	}
+
+	handle, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+
+	defer syscall.CloseHandle(handle)
+	var code uint32
+	if err := syscall.GetExitCodeProcess(handle, &code); err != nil {
+		return false
+	}
+	return code == stillActive
+}
+
+func killProcess(pid int) error {
+
+	return exec.Command("taskkill", "/F", "/T", "/PID", fmt.Sprint(pid)).Run()
+}
+
+//syncDirectory windows can not fsync a directory, rename is durable after it returned.
+func syncDirectory(path string) error {
+
+	return nil
+}
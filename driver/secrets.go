@@ -0,0 +1,157 @@
+package driver
+
+import "github.com/cloudtask/libtools/gounits/logger"
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	//环境变量值引用密钥前缀, 例如: DB_PASSWORD=secret://db_password
+	SECRET_REF_PREFIX = "secret://"
+	//输出中密钥值的替换内容
+	SECRET_MASK = "******"
+)
+
+var (
+	//密钥引用名称无效
+	ErrSecretNameInvalid = errors.New("secret reference name invalid.")
+	//密钥未找到
+	ErrSecretNotFound = errors.New("secret reference not found.")
+)
+
+/*
+SecretStore 本地密钥存储
+密钥只在执行时从agent本地读取, 不会写入job.json.
+Directory: 目录下每个文件为一个密钥, 文件名为密钥名称, 文件内容为密钥值.
+File: 每行格式为 NAME=VALUE, 以#开头为注释.
+同名密钥Directory优先.
+*/
+type SecretStore struct {
+	Directory string //密钥目录
+	File      string //密钥文件
+}
+
+//NewSecretStore is exported
+func NewSecretStore(directory string, file string) *SecretStore {
+
+	return &SecretStore{
+		Directory: strings.TrimSpace(directory),
+		File:      strings.TrimSpace(file),
+	}
+}
+
+/*
+Resolve 解析环境变量中的密钥引用
+返回解析后的环境变量与本次使用到的密钥值(用于输出脱敏).
+*/
+func (store *SecretStore) Resolve(env []string) ([]string, []string, error) {
+
+	resolved := make([]string, 0, len(env))
+	secrets := []string{}
+	var values map[string]string
+	for _, pair := range env {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || !strings.HasPrefix(kv[1], SECRET_REF_PREFIX) {
+			resolved = append(resolved, pair)
+			continue
+		}
+		name := strings.TrimPrefix(kv[1], SECRET_REF_PREFIX)
+		if values == nil {
+			var err error
+			if values, err = store.readFile(); err != nil {
+				return nil, nil, err
+			}
+		}
+		value, err := store.lookup(name, values)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s %s", err.Error(), kv[0])
+		}
+		resolved = append(resolved, kv[0]+"="+value)
+		if value != "" {
+			secrets = append(secrets, value)
+		}
+	}
+	return resolved, secrets, nil
+}
+
+func (store *SecretStore) lookup(name string, values map[string]string) (string, error) {
+
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", ErrSecretNameInvalid
+	}
+
+	if store.Directory != "" {
+		buf, err := ioutil.ReadFile(filepath.Join(store.Directory, name))
+		if err == nil {
+			return strings.TrimRight(string(buf), "\r\n"), nil
+		}
+		if !os.IsNotExist(err) {
+			logger.ERROR("[#driver#] secret %s read error:%s", name, err)
+			return "", err
+		}
+	}
+
+	if value, ret := values[name]; ret {
+		return value, nil
+	}
+	return "", ErrSecretNotFound
+}
+
+func (store *SecretStore) readFile() (map[string]string, error) {
+
+	values := map[string]string{}
+	if store.File == "" {
+		return values, nil
+	}
+
+	fd, err := os.Open(store.File)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return values, nil
+		}
+		logger.ERROR("[#driver#] secret file %s open error:%s", store.File, err)
+		return nil, err
+	}
+
+	defer fd.Close()
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) == 2 {
+			values[strings.TrimSpace(kv[0])] = kv[1]
+		}
+	}
+	return values, scanner.Err()
+}
+
+/*
+MaskSecrets 输出脱敏
+将输出内容中出现的密钥值替换为SECRET_MASK, 优先替换较长的值.
+*/
+func MaskSecrets(data string, secrets []string) string {
+
+	if data == "" || len(secrets) == 0 {
+		return data
+	}
+
+	values := append([]string{}, secrets...)
+	sort.Slice(values, func(i, j int) bool {
+		return len(values[i]) > len(values[j])
+	})
+	for _, value := range values {
+		data = strings.Replace(data, value, SECRET_MASK, -1)
+	}
+	return data
+}
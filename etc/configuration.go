@@ -2,6 +2,8 @@ package etc
 
 import "github.com/cloudtask/common/models"
 import "github.com/cloudtask/cloudtask-agent/cache"
+import "github.com/cloudtask/cloudtask-agent/driver"
+import "github.com/cloudtask/cloudtask-agent/history"
 import "github.com/cloudtask/libtools/gounits/logger"
 import "github.com/cloudtask/libtools/gounits/system"
 import "github.com/cloudtask/libtools/gzkwrapper"
@@ -35,6 +37,30 @@ var (
 	ErrConfigServerDataInvalid = errors.New("config server data invalid")
 )
 
+/*
+CacheSource is exported
+job文件包源配置, type: http | file | s3
+s3源的secretkey不输出到接口与日志
+*/
+type CacheSource struct {
+	Name      string `yaml:"name" json:"name"`
+	Type      string `yaml:"type" json:"type"`
+	URL       string `yaml:"url" json:"url"`
+	Bucket    string `yaml:"bucket" json:"bucket"`
+	Prefix    string `yaml:"prefix" json:"prefix"`
+	Region    string `yaml:"region" json:"region"`
+	AccessKey string `yaml:"accesskey" json:"accesskey"`
+	SecretKey string `yaml:"secretkey" json:"-"`
+}
+
+//String is exported
+//hide secretkey in logs.
+func (source *CacheSource) String() string {
+
+	return fmt.Sprintf("{Name:%s Type:%s URL:%s Bucket:%s Prefix:%s Region:%s AccessKey:%s SecretKey:%v}",
+		source.Name, source.Type, source.URL, source.Bucket, source.Prefix, source.Region, source.AccessKey, source.SecretKey != "")
+}
+
 // Configuration is exported
 type Configuration struct {
 	Version         string `yaml:"version" json:"version"`
@@ -58,16 +84,47 @@ type Configuration struct {
 	API struct {
 		Hosts      []string `yaml:"hosts" json:"hosts"`
 		EnableCors bool     `yaml:"enablecors" json:"enablecors"`
+		Token      string   `yaml:"token" json:"-"` //中心服务推送接口认证令牌, 不输出
 	} `yaml:"api" json:"api"`
 
 	Cache struct {
-		MaxJobs       int    `yaml:"maxjobs" json:"maxjobs"`
-		SaveDirectory string `yaml:"savedirectory" json:"savedirectory"`
-		AutoClean     bool   `yaml:"autoclean" json:"autoclean"`
-		CleanInterval string `yaml:"cleaninterval" json:"cleaninterval"`
-		PullRecovery  string `yaml:"pullrecovery" json:"pullrecovery"`
+		MaxJobs           int            `yaml:"maxjobs" json:"maxjobs"`
+		SaveDirectory     string         `yaml:"savedirectory" json:"savedirectory"`
+		AutoClean         bool           `yaml:"autoclean" json:"autoclean"`
+		CleanInterval     string         `yaml:"cleaninterval" json:"cleaninterval"`
+		PullRecovery      string         `yaml:"pullrecovery" json:"pullrecovery"`
+		PullParallel      int            `yaml:"pullparallel" json:"pullparallel"`
+		PullTimeout       string         `yaml:"pulltimeout" json:"pulltimeout"`
+		TrustedKeys       []string       `yaml:"trustedkeys" json:"trustedkeys"`
+		PeerShare         bool           `yaml:"peershare" json:"peershare"`
+		ExtractMaxBytes   int64          `yaml:"extractmaxbytes" json:"extractmaxbytes"`
+		ExtractMaxEntries int            `yaml:"extractmaxentries" json:"extractmaxentries"`
+		ExtractMaxDepth   int            `yaml:"extractmaxdepth" json:"extractmaxdepth"`
+		MaxSize           int64          `yaml:"maxsize" json:"maxsize"`
+		MinFree           int64          `yaml:"minfree" json:"minfree"`
+		JobRetention      string         `yaml:"jobretention" json:"jobretention"`
+		OfflineMode       bool           `yaml:"offlinemode" json:"offlinemode"`
+		AllocNode         bool           `yaml:"allocnode" json:"allocnode"`
+		Sources           []*CacheSource `yaml:"sources" json:"sources"`
 	} `yaml:"cache" json:"cache"`
 
+	Driver struct {
+		SecretsDirectory string `yaml:"secretsdirectory" json:"secretsdirectory"`
+		SecretsFile      string `yaml:"secretsfile" json:"secretsfile"`
+		TimeoutWarning   int    `yaml:"timeoutwarning" json:"timeoutwarning"`
+		TimeoutSignal    string `yaml:"timeoutsignal" json:"timeoutsignal"`
+		StopGrace        string `yaml:"stopgrace" json:"stopgrace"`
+		OrphanPolicy     string `yaml:"orphanpolicy" json:"orphanpolicy"`
+		DrainTimeout     string `yaml:"draintimeout" json:"draintimeout"`
+	} `yaml:"driver" json:"driver"`
+
+	History struct {
+		Enabled    bool   `yaml:"enabled" json:"enabled"`
+		MaxSize    int64  `yaml:"maxsize" json:"maxsize"`
+		MaxAge     string `yaml:"maxage" json:"maxage"`
+		OutputSize int    `yaml:"outputsize" json:"outputsize"`
+	} `yaml:"history" json:"history"`
+
 	Logger struct {
 		LogFile  string `yaml:"logfile" json:"logfile"`
 		LogLevel string `yaml:"loglevel" json:"loglevel"`
@@ -130,8 +187,10 @@ func New(file string) error {
 	log.Printf("[#etc#] centerhost: %s\n", SystemConfig.CenterHost)
 	log.Printf("[#etc#] websitehost: %s\n", SystemConfig.WebsiteHost)
 	log.Printf("[#etc#] cluster: %+v\n", SystemConfig.Cluster)
-	log.Printf("[#etc#] APIlisten: %+v\n", SystemConfig.API)
+	log.Printf("[#etc#] APIlisten: {Hosts:%v EnableCors:%v Token:%v}\n", SystemConfig.API.Hosts, SystemConfig.API.EnableCors, SystemConfig.API.Token != "")
 	log.Printf("[#etc#] cache: %+v\n", SystemConfig.Cache)
+	log.Printf("[#etc#] driver: %+v\n", SystemConfig.Driver)
+	log.Printf("[#etc#] history: %+v\n", SystemConfig.History)
 	log.Printf("[#etc#] logger: %+v\n", SystemConfig.Logger)
 	return nil
 }
@@ -168,6 +227,15 @@ func RetryStartup() bool {
 	return false
 }
 
+//APIToken is exported
+func APIToken() string {
+
+	if SystemConfig != nil {
+		return SystemConfig.API.Token
+	}
+	return ""
+}
+
 //UseServerConfig is exported
 func UseServerConfig() bool {
 
@@ -219,13 +287,78 @@ func CacheConfigs() *cache.CacheConfigs {
 
 	if SystemConfig != nil {
 		return &cache.CacheConfigs{
-			CenterHost:    SystemConfig.CenterHost,
-			WebsiteHost:   SystemConfig.WebsiteHost,
-			MaxJobs:       SystemConfig.Cache.MaxJobs,
-			SaveDirectory: SystemConfig.Cache.SaveDirectory,
-			AutoClean:     SystemConfig.Cache.AutoClean,
-			CleanInterval: SystemConfig.Cache.CleanInterval,
-			PullRecovery:  SystemConfig.Cache.PullRecovery,
+			CenterHost:        SystemConfig.CenterHost,
+			WebsiteHost:       SystemConfig.WebsiteHost,
+			MaxJobs:           SystemConfig.Cache.MaxJobs,
+			SaveDirectory:     SystemConfig.Cache.SaveDirectory,
+			AutoClean:         SystemConfig.Cache.AutoClean,
+			CleanInterval:     SystemConfig.Cache.CleanInterval,
+			PullRecovery:      SystemConfig.Cache.PullRecovery,
+			PullParallel:      SystemConfig.Cache.PullParallel,
+			PullTimeout:       SystemConfig.Cache.PullTimeout,
+			TrustedKeys:       SystemConfig.Cache.TrustedKeys,
+			PeerShare:         SystemConfig.Cache.PeerShare,
+			PeerToken:         SystemConfig.API.Token,
+			ExtractMaxBytes:   SystemConfig.Cache.ExtractMaxBytes,
+			ExtractMaxEntries: SystemConfig.Cache.ExtractMaxEntries,
+			ExtractMaxDepth:   SystemConfig.Cache.ExtractMaxDepth,
+			MaxSize:           SystemConfig.Cache.MaxSize,
+			MinFree:           SystemConfig.Cache.MinFree,
+			JobRetention:      SystemConfig.Cache.JobRetention,
+			OfflineMode:       SystemConfig.Cache.OfflineMode,
+			AllocNode:         SystemConfig.Cache.AllocNode,
+			Sources:           cacheSources(SystemConfig.Cache.Sources),
+		}
+	}
+	return nil
+}
+
+func cacheSources(sources []*CacheSource) []*cache.SourceConfigs {
+
+	configs := []*cache.SourceConfigs{}
+	for _, source := range sources {
+		configs = append(configs, &cache.SourceConfigs{
+			Name:      source.Name,
+			Type:      source.Type,
+			URL:       source.URL,
+			Bucket:    source.Bucket,
+			Prefix:    source.Prefix,
+			Region:    source.Region,
+			AccessKey: source.AccessKey,
+			SecretKey: source.SecretKey,
+		})
+	}
+	return configs
+}
+
+//DriverConfigs is exported
+func DriverConfigs() *driver.DriverConfigs {
+
+	if SystemConfig != nil {
+		return &driver.DriverConfigs{
+			Root:             SystemConfig.Cache.SaveDirectory,
+			SecretsDirectory: SystemConfig.Driver.SecretsDirectory,
+			SecretsFile:      SystemConfig.Driver.SecretsFile,
+			TimeoutWarning:   SystemConfig.Driver.TimeoutWarning,
+			TimeoutSignal:    SystemConfig.Driver.TimeoutSignal,
+			StopGrace:        SystemConfig.Driver.StopGrace,
+			OrphanPolicy:     SystemConfig.Driver.OrphanPolicy,
+			DrainTimeout:     SystemConfig.Driver.DrainTimeout,
+		}
+	}
+	return nil
+}
+
+//HistoryConfigs is exported
+func HistoryConfigs() *history.HistoryConfigs {
+
+	if SystemConfig != nil {
+		return &history.HistoryConfigs{
+			Root:       SystemConfig.Cache.SaveDirectory,
+			Enabled:    SystemConfig.History.Enabled,
+			MaxSize:    SystemConfig.History.MaxSize,
+			MaxAge:     SystemConfig.History.MaxAge,
+			OutputSize: SystemConfig.History.OutputSize,
 		}
 	}
 	return nil
@@ -308,6 +441,54 @@ func parseDefaultParmeters(conf *Configuration) {
 		conf.Cache.PullRecovery = "300s"
 	}
 
+	if conf.Cache.PullParallel <= 0 {
+		conf.Cache.PullParallel = 4
+	}
+
+	if conf.Cache.PullTimeout == "" {
+		conf.Cache.PullTimeout = "10m"
+	}
+
+	if conf.Cache.JobRetention == "" {
+		conf.Cache.JobRetention = "24h"
+	}
+
+	if conf.Cache.ExtractMaxBytes <= 0 {
+		conf.Cache.ExtractMaxBytes = cache.DEFAULT_EXTRACT_MAXBYTES
+	}
+
+	if conf.Cache.ExtractMaxEntries <= 0 {
+		conf.Cache.ExtractMaxEntries = cache.DEFAULT_EXTRACT_MAXENTRIES
+	}
+
+	if conf.Cache.ExtractMaxDepth <= 0 {
+		conf.Cache.ExtractMaxDepth = cache.DEFAULT_EXTRACT_MAXDEPTH
+	}
+
+	if conf.Driver.StopGrace == "" {
+		conf.Driver.StopGrace = "5s"
+	}
+
+	if conf.Driver.OrphanPolicy == "" {
+		conf.Driver.OrphanPolicy = "adopt"
+	}
+
+	if conf.Driver.DrainTimeout == "" {
+		conf.Driver.DrainTimeout = "5m"
+	}
+
+	if conf.History.MaxSize == 0 {
+		conf.History.MaxSize = 104857600
+	}
+
+	if conf.History.MaxAge == "" {
+		conf.History.MaxAge = "168h"
+	}
+
+	if conf.History.OutputSize == 0 {
+		conf.History.OutputSize = 65536
+	}
+
 	if conf.Logger.LogLevel == "" {
 		conf.Logger.LogLevel = "info"
 	}
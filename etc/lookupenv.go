@@ -1,11 +1,14 @@
 package etc
 
+import "gopkg.in/yaml.v2"
+
 import (
 	"fmt"
 	"net"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -60,6 +63,16 @@ func (conf *Configuration) parseEnv() error {
 	if err = parseCacheEnv(conf); err != nil {
 		return err
 	}
+
+	//parse driver env
+	if err = parseDriverEnv(conf); err != nil {
+		return err
+	}
+
+	//parse history env
+	if err = parseHistoryEnv(conf); err != nil {
+		return err
+	}
 	//parse logger env
 	return parseLoggerEnv(conf)
 }
@@ -124,6 +137,10 @@ func parseAPIEnv(conf *Configuration) error {
 		}
 		conf.API.EnableCors = value
 	}
+
+	if token := os.Getenv("CLOUDTASK_API_TOKEN"); token != "" {
+		conf.API.Token = token
+	}
 	return nil
 }
 
@@ -162,6 +179,184 @@ func parseCacheEnv(conf *Configuration) error {
 		}
 		conf.Cache.PullRecovery = pullRecovery
 	}
+
+	if pullParallel := os.Getenv("CLOUDTASK_CACHE_PULLPARALLEL"); pullParallel != "" {
+		value, err := strconv.Atoi(pullParallel)
+		if err != nil {
+			return fmt.Errorf("CLOUDTASK_CACHE_PULLPARALLEL invalid, %s", err.Error())
+		}
+		conf.Cache.PullParallel = value
+	}
+
+	if pullTimeout := os.Getenv("CLOUDTASK_CACHE_PULLTIMEOUT"); pullTimeout != "" {
+		if _, err := time.ParseDuration(pullTimeout); err != nil {
+			return fmt.Errorf("CLOUDTASK_CACHE_PULLTIMEOUT invalid, %s", err.Error())
+		}
+		conf.Cache.PullTimeout = pullTimeout
+	}
+
+	if trustedKeys := os.Getenv("CLOUDTASK_CACHE_TRUSTEDKEYS"); trustedKeys != "" {
+		conf.Cache.TrustedKeys = strings.Split(trustedKeys, ",")
+	}
+
+	if peerShare := os.Getenv("CLOUDTASK_CACHE_PEERSHARE"); peerShare != "" {
+		value, err := strconv.ParseBool(peerShare)
+		if err != nil {
+			return fmt.Errorf("CLOUDTASK_CACHE_PEERSHARE invalid, %s", err.Error())
+		}
+		conf.Cache.PeerShare = value
+	}
+
+	if extractMaxBytes := os.Getenv("CLOUDTASK_CACHE_EXTRACTMAXBYTES"); extractMaxBytes != "" {
+		value, err := strconv.ParseInt(extractMaxBytes, 10, 64)
+		if err != nil {
+			return fmt.Errorf("CLOUDTASK_CACHE_EXTRACTMAXBYTES invalid, %s", err.Error())
+		}
+		conf.Cache.ExtractMaxBytes = value
+	}
+
+	if extractMaxEntries := os.Getenv("CLOUDTASK_CACHE_EXTRACTMAXENTRIES"); extractMaxEntries != "" {
+		value, err := strconv.Atoi(extractMaxEntries)
+		if err != nil {
+			return fmt.Errorf("CLOUDTASK_CACHE_EXTRACTMAXENTRIES invalid, %s", err.Error())
+		}
+		conf.Cache.ExtractMaxEntries = value
+	}
+
+	if extractMaxDepth := os.Getenv("CLOUDTASK_CACHE_EXTRACTMAXDEPTH"); extractMaxDepth != "" {
+		value, err := strconv.Atoi(extractMaxDepth)
+		if err != nil {
+			return fmt.Errorf("CLOUDTASK_CACHE_EXTRACTMAXDEPTH invalid, %s", err.Error())
+		}
+		conf.Cache.ExtractMaxDepth = value
+	}
+
+	if maxSize := os.Getenv("CLOUDTASK_CACHE_MAXSIZE"); maxSize != "" {
+		value, err := strconv.ParseInt(maxSize, 10, 64)
+		if err != nil {
+			return fmt.Errorf("CLOUDTASK_CACHE_MAXSIZE invalid, %s", err.Error())
+		}
+		conf.Cache.MaxSize = value
+	}
+
+	if minFree := os.Getenv("CLOUDTASK_CACHE_MINFREE"); minFree != "" {
+		value, err := strconv.ParseInt(minFree, 10, 64)
+		if err != nil {
+			return fmt.Errorf("CLOUDTASK_CACHE_MINFREE invalid, %s", err.Error())
+		}
+		conf.Cache.MinFree = value
+	}
+
+	if jobRetention := os.Getenv("CLOUDTASK_CACHE_JOBRETENTION"); jobRetention != "" {
+		if _, err := time.ParseDuration(jobRetention); err != nil {
+			return fmt.Errorf("CLOUDTASK_CACHE_JOBRETENTION invalid, %s", err.Error())
+		}
+		conf.Cache.JobRetention = jobRetention
+	}
+
+	if offlineMode := os.Getenv("CLOUDTASK_CACHE_OFFLINEMODE"); offlineMode != "" {
+		value, err := strconv.ParseBool(offlineMode)
+		if err != nil {
+			return fmt.Errorf("CLOUDTASK_CACHE_OFFLINEMODE invalid, %s", err.Error())
+		}
+		conf.Cache.OfflineMode = value
+	}
+
+	if allocNode := os.Getenv("CLOUDTASK_CACHE_ALLOCNODE"); allocNode != "" {
+		value, err := strconv.ParseBool(allocNode)
+		if err != nil {
+			return fmt.Errorf("CLOUDTASK_CACHE_ALLOCNODE invalid, %s", err.Error())
+		}
+		conf.Cache.AllocNode = value
+	}
+
+	if sources := os.Getenv("CLOUDTASK_CACHE_SOURCES"); sources != "" { //json数组, 如: [{"type":"http","url":"http://mirror/files"}]
+		value := []*CacheSource{}
+		if err := yaml.Unmarshal([]byte(sources), &value); err != nil {
+			return fmt.Errorf("CLOUDTASK_CACHE_SOURCES invalid, %s", err.Error())
+		}
+		conf.Cache.Sources = value
+	}
+	return nil
+}
+
+func parseDriverEnv(conf *Configuration) error {
+
+	if secretsDirectory := os.Getenv("CLOUDTASK_DRIVER_SECRETSDIRECTORY"); secretsDirectory != "" {
+		conf.Driver.SecretsDirectory = secretsDirectory
+	}
+
+	if secretsFile := os.Getenv("CLOUDTASK_DRIVER_SECRETSFILE"); secretsFile != "" {
+		conf.Driver.SecretsFile = secretsFile
+	}
+
+	if timeoutWarning := os.Getenv("CLOUDTASK_DRIVER_TIMEOUTWARNING"); timeoutWarning != "" {
+		value, err := strconv.Atoi(timeoutWarning)
+		if err != nil || value < 0 || value >= 100 {
+			return fmt.Errorf("CLOUDTASK_DRIVER_TIMEOUTWARNING invalid, %s", timeoutWarning)
+		}
+		conf.Driver.TimeoutWarning = value
+	}
+
+	if timeoutSignal := os.Getenv("CLOUDTASK_DRIVER_TIMEOUTSIGNAL"); timeoutSignal != "" {
+		conf.Driver.TimeoutSignal = timeoutSignal
+	}
+
+	if stopGrace := os.Getenv("CLOUDTASK_DRIVER_STOPGRACE"); stopGrace != "" {
+		if _, err := time.ParseDuration(stopGrace); err != nil {
+			return fmt.Errorf("CLOUDTASK_DRIVER_STOPGRACE invalid, %s", err.Error())
+		}
+		conf.Driver.StopGrace = stopGrace
+	}
+
+	if orphanPolicy := os.Getenv("CLOUDTASK_DRIVER_ORPHANPOLICY"); orphanPolicy != "" {
+		if orphanPolicy != "adopt" && orphanPolicy != "kill" {
+			return fmt.Errorf("CLOUDTASK_DRIVER_ORPHANPOLICY invalid, %s", orphanPolicy)
+		}
+		conf.Driver.OrphanPolicy = orphanPolicy
+	}
+
+	if drainTimeout := os.Getenv("CLOUDTASK_DRIVER_DRAINTIMEOUT"); drainTimeout != "" {
+		if _, err := time.ParseDuration(drainTimeout); err != nil {
+			return fmt.Errorf("CLOUDTASK_DRIVER_DRAINTIMEOUT invalid, %s", err.Error())
+		}
+		conf.Driver.DrainTimeout = drainTimeout
+	}
+	return nil
+}
+
+func parseHistoryEnv(conf *Configuration) error {
+
+	if enabled := os.Getenv("CLOUDTASK_HISTORY_ENABLED"); enabled != "" {
+		value, err := strconv.ParseBool(enabled)
+		if err != nil {
+			return fmt.Errorf("CLOUDTASK_HISTORY_ENABLED invalid, %s", err.Error())
+		}
+		conf.History.Enabled = value
+	}
+
+	if maxSize := os.Getenv("CLOUDTASK_HISTORY_MAXSIZE"); maxSize != "" {
+		value, err := strconv.ParseInt(maxSize, 10, 64)
+		if err != nil {
+			return fmt.Errorf("CLOUDTASK_HISTORY_MAXSIZE invalid, %s", err.Error())
+		}
+		conf.History.MaxSize = value
+	}
+
+	if maxAge := os.Getenv("CLOUDTASK_HISTORY_MAXAGE"); maxAge != "" {
+		if _, err := time.ParseDuration(maxAge); err != nil {
+			return fmt.Errorf("CLOUDTASK_HISTORY_MAXAGE invalid, %s", err.Error())
+		}
+		conf.History.MaxAge = maxAge
+	}
+
+	if outputSize := os.Getenv("CLOUDTASK_HISTORY_OUTPUTSIZE"); outputSize != "" {
+		value, err := strconv.Atoi(outputSize)
+		if err != nil {
+			return fmt.Errorf("CLOUDTASK_HISTORY_OUTPUTSIZE invalid, %s", err.Error())
+		}
+		conf.History.OutputSize = value
+	}
 	return nil
 }
 
@@ -0,0 +1,535 @@
+package history
+
+import "github.com/cloudtask/libtools/gounits/logger"
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//segment文件名前缀与后缀
+	segmentPrefix = "runs-"
+	segmentSuffix = ".log"
+	//segment输出目录后缀
+	outputSuffix = ".d"
+	//单个segment最长写入时长, 超过后轮转, 保证按时间过期清理粒度
+	segmentMaxAge = 24 * time.Hour
+	//定时检查轮转与保留时长的间隔, 没有新记录时也按时清理
+	retentionInterval = 10 * time.Minute
+)
+
+var (
+	//ErrRunNotFound is exported
+	ErrRunNotFound = errors.New("run history not found.")
+)
+
+//HistoryConfigs is exported
+type HistoryConfigs struct {
+	Root       string
+	Enabled    bool
+	MaxSize    int64
+	MaxAge     string
+	OutputSize int
+}
+
+/*
+RunRecord is exported
+执行记录, 每次执行状态变化追加一条, 同一RunId以最后一条为准.
+*/
+type RunRecord struct {
+	RunId     string    `json:"runid"`
+	JobId     string    `json:"jobid"`
+	State     int       `json:"state"`
+	ExecAt    time.Time `json:"execat"`
+	EndAt     time.Time `json:"endat"`
+	ExecTimes float64   `json:"exectimes"`
+	ExitCode  int       `json:"exitcode"`
+	ExecErr   string    `json:"execerr"`
+	Output    string    `json:"output,omitempty"` //截断后的输出文件(相对history根目录)
+}
+
+/*
+RunOutput is exported
+截断后的执行输出
+*/
+type RunOutput struct {
+	StdOut string `json:"stdout"`
+	ErrOut string `json:"errout"`
+}
+
+/*
+RunStore is exported
+本地执行历史存储
+1、只追加写入segment文件(JSON Lines), 按大小或时长轮转
+2、按总大小与保留时长清理最旧的segment及其输出目录
+3、center不可用时仍可在本地查询执行记录
+*/
+type RunStore struct {
+	sync.Mutex
+	Root       string        //history根目录
+	Enabled    bool          //是否开启
+	MaxSize    int64         //总大小上限(bytes)
+	MaxAge     time.Duration //保留时长
+	OutputSize int           //stdout/stderr各自保留的最大长度(bytes)
+	segment    *os.File      //当前写入的segment
+	segmentAt  time.Time     //当前segment创建时间
+	offset     int64         //当前segment写入位置
+	index      map[string]*runIndex
+	stopCh     chan struct{}
+}
+
+/*
+runIndex 执行记录索引, 指向RunId最后一条记录在segment中的位置
+查询时只在锁内读取索引, 在锁外按位置读取记录, 避免阻塞Append.
+*/
+type runIndex struct {
+	JobId   string
+	ExecAt  time.Time
+	Output  string //较早记录中的输出文件, 最后一条记录没有输出时使用
+	Segment string
+	Offset  int64
+	Length  int
+}
+
+//NewRunStore is exported
+func NewRunStore(configs *HistoryConfigs) *RunStore {
+
+	maxAge, err := time.ParseDuration(configs.MaxAge)
+	if err != nil {
+		maxAge = 7 * 24 * time.Hour
+	}
+
+	return &RunStore{
+		Root:       configs.Root + "/history",
+		Enabled:    configs.Enabled,
+		MaxSize:    configs.MaxSize,
+		MaxAge:     maxAge,
+		OutputSize: configs.OutputSize,
+		index:      make(map[string]*runIndex),
+	}
+}
+
+//Open is exported
+func (store *RunStore) Open() error {
+
+	if !store.Enabled {
+		return nil
+	}
+
+	store.Lock()
+	defer store.Unlock()
+	if err := os.MkdirAll(store.Root, 0777); err != nil {
+		return err
+	}
+	store.applyRetention()
+	if err := store.rotate(); err != nil {
+		return err
+	}
+
+	store.index = make(map[string]*runIndex)
+	for _, segment := range store.segments() {
+		store.indexSegment(segment)
+	}
+
+	if store.stopCh == nil {
+		store.stopCh = make(chan struct{})
+		go store.retentionLoop(store.stopCh)
+	}
+	return nil
+}
+
+//Close is exported
+func (store *RunStore) Close() {
+
+	store.Lock()
+	if store.stopCh != nil {
+		close(store.stopCh)
+		store.stopCh = nil
+	}
+	if store.segment != nil {
+		store.segment.Close()
+		store.segment = nil
+	}
+	store.Unlock()
+}
+
+//retentionLoop rotate and prune segments periodically, a quiet agent never appends.
+func (store *RunStore) retentionLoop(stopCh chan struct{}) {
+
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			store.Lock()
+			if store.segment != nil {
+				store.checkRotate()
+			}
+			store.Unlock()
+		}
+	}
+}
+
+//checkRotate rotate current segment when it is full or too old, then apply retention, store lock must be held.
+func (store *RunStore) checkRotate() {
+
+	if info, err := store.segment.Stat(); err == nil {
+		if info.Size() >= store.segmentSize() || time.Since(store.segmentAt) >= segmentMaxAge {
+			if err := store.rotate(); err != nil {
+				logger.ERROR("[#history#] rotate segment error, %s", err)
+			}
+		}
+	}
+	store.applyRetention()
+}
+
+//indexSegment scan a segment and index its records, store lock must be held.
+func (store *RunStore) indexSegment(segment string) {
+
+	fd, err := os.Open(filepath.Join(store.Root, segment))
+	if err != nil {
+		return
+	}
+
+	defer fd.Close()
+	reader := bufio.NewReaderSize(fd, 64*1024)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			record := &RunRecord{}
+			if json.Unmarshal(line, record) == nil { //忽略崩溃时写入不完整的记录
+				store.indexRecord(record, segment, offset, len(line))
+			}
+		}
+		offset += int64(len(line))
+		if err != nil {
+			return
+		}
+	}
+}
+
+//indexRecord point runid to its latest record, store lock must be held.
+func (store *RunStore) indexRecord(record *RunRecord, segment string, offset int64, length int) {
+
+	output := record.Output
+	if origin, ret := store.index[record.RunId]; ret && output == "" {
+		output = origin.Output
+	}
+
+	store.index[record.RunId] = &runIndex{
+		JobId:   record.JobId,
+		ExecAt:  record.ExecAt,
+		Output:  output,
+		Segment: segment,
+		Offset:  offset,
+		Length:  length,
+	}
+}
+
+/*
+Append is exported
+追加一条执行记录, stdout/errout非空时截断保存到segment输出目录.
+*/
+func (store *RunStore) Append(record *RunRecord, stdout string, errout string) error {
+
+	if !store.Enabled || record.RunId == "" {
+		return nil
+	}
+
+	store.Lock()
+	defer store.Unlock()
+	if store.segment == nil {
+		return fmt.Errorf("run history store not opened.")
+	}
+
+	if info, err := store.segment.Stat(); err == nil {
+		if info.Size() >= store.segmentSize() || time.Since(store.segmentAt) >= segmentMaxAge {
+			store.checkRotate()
+		}
+	}
+
+	if stdout != "" || errout != "" {
+		output, err := store.writeOutput(record.RunId, stdout, errout)
+		if err != nil {
+			logger.ERROR("[#history#] write run %s output error, %s", record.RunId, err)
+		} else {
+			record.Output = output
+		}
+	}
+
+	buf, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	buf = append(buf, '\n')
+	n, err := store.segment.Write(buf)
+	if err != nil {
+		logger.ERROR("[#history#] append run %s error, %s", record.RunId, err)
+	} else {
+		store.indexRecord(record, filepath.Base(store.segment.Name()), store.offset, n)
+	}
+	store.offset += int64(n)
+	return err
+}
+
+/*
+GetRuns is exported
+返回某个job的执行记录, 按执行时间倒序, limit<=0返回全部.
+*/
+func (store *RunStore) GetRuns(jobid string, limit int) []*RunRecord {
+
+	indexes := store.lookup(func(index *runIndex) bool {
+		return index.JobId == jobid
+	})
+
+	sort.Slice(indexes, func(i, j int) bool {
+		return indexes[i].ExecAt.After(indexes[j].ExecAt)
+	})
+
+	if limit > 0 && len(indexes) > limit {
+		indexes = indexes[:limit]
+	}
+	return store.readRecords(indexes)
+}
+
+/*
+GetRun is exported
+返回一次执行记录与其截断输出.
+*/
+func (store *RunStore) GetRun(runid string) (*RunRecord, *RunOutput, error) {
+
+	indexes := []*runIndex{}
+	if store.Enabled {
+		store.Lock()
+		if index, ret := store.index[runid]; ret {
+			value := *index
+			indexes = append(indexes, &value)
+		}
+		store.Unlock()
+	}
+
+	records := store.readRecords(indexes)
+	if len(records) == 0 {
+		return nil, nil, ErrRunNotFound
+	}
+
+	record := records[0]
+	output := &RunOutput{}
+	if record.Output != "" {
+		buf, err := ioutil.ReadFile(filepath.Join(store.Root, record.Output))
+		if err == nil {
+			json.Unmarshal(buf, output)
+		}
+	}
+	return record, output, nil
+}
+
+//lookup return copies of matched indexes.
+func (store *RunStore) lookup(match func(index *runIndex) bool) []*runIndex {
+
+	indexes := []*runIndex{}
+	if !store.Enabled {
+		return indexes
+	}
+
+	store.Lock()
+	defer store.Unlock()
+	for _, index := range store.index {
+		if match(index) {
+			value := *index
+			indexes = append(indexes, &value)
+		}
+	}
+	return indexes
+}
+
+//readRecords read indexed records outside store lock, records of removed segments are skipped.
+func (store *RunStore) readRecords(indexes []*runIndex) []*RunRecord {
+
+	records := []*RunRecord{}
+	files := map[string]*os.File{}
+	defer func() {
+		for _, fd := range files {
+			fd.Close()
+		}
+	}()
+
+	for _, index := range indexes {
+		fd, ret := files[index.Segment]
+		if !ret {
+			var err error
+			if fd, err = os.Open(filepath.Join(store.Root, index.Segment)); err != nil {
+				continue
+			}
+			files[index.Segment] = fd
+		}
+		buf := make([]byte, index.Length)
+		if _, err := fd.ReadAt(buf, index.Offset); err != nil {
+			continue
+		}
+		record := &RunRecord{}
+		if err := json.Unmarshal(buf, record); err != nil {
+			continue
+		}
+		if record.Output == "" {
+			record.Output = index.Output
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func (store *RunStore) writeOutput(runid string, stdout string, errout string) (string, error) {
+
+	name := strings.TrimSuffix(filepath.Base(store.segment.Name()), segmentSuffix) + outputSuffix
+	if err := os.MkdirAll(filepath.Join(store.Root, name), 0777); err != nil {
+		return "", err
+	}
+
+	output := &RunOutput{
+		StdOut: truncate(stdout, store.OutputSize),
+		ErrOut: truncate(errout, store.OutputSize),
+	}
+
+	buf, err := json.Marshal(output)
+	if err != nil {
+		return "", err
+	}
+
+	fname := name + "/" + runid + ".json"
+	if err := ioutil.WriteFile(filepath.Join(store.Root, fname), buf, 0666); err != nil {
+		return "", err
+	}
+	return fname, nil
+}
+
+//rotate close current segment and create a new segment.
+func (store *RunStore) rotate() error {
+
+	if store.segment != nil {
+		store.segment.Close()
+		store.segment = nil
+	}
+
+	now := time.Now()
+	fname := fmt.Sprintf("%s%d%s", segmentPrefix, now.UnixNano(), segmentSuffix)
+	fd, err := os.OpenFile(filepath.Join(store.Root, fname), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	store.segment = fd
+	store.segmentAt = now
+	store.offset = 0
+	return nil
+}
+
+//applyRetention remove oldest segments which exceed maxage or maxsize, current segment is retained.
+func (store *RunStore) applyRetention() {
+
+	segments := store.segments()
+	current := ""
+	if store.segment != nil {
+		current = filepath.Base(store.segment.Name())
+	}
+
+	sizes := map[string]int64{}
+	var total int64
+	for _, segment := range segments {
+		size := pathSize(filepath.Join(store.Root, segment)) + pathSize(filepath.Join(store.Root, outputDirectory(segment)))
+		sizes[segment] = size
+		total += size
+	}
+
+	for _, segment := range segments { //segments按创建时间升序
+		if segment == current {
+			continue
+		}
+		expired := false
+		if info, err := os.Stat(filepath.Join(store.Root, segment)); err == nil {
+			expired = time.Since(info.ModTime()) > store.MaxAge
+		}
+		if !expired && (store.MaxSize <= 0 || total <= store.MaxSize) {
+			continue
+		}
+		os.RemoveAll(filepath.Join(store.Root, outputDirectory(segment)))
+		if err := os.Remove(filepath.Join(store.Root, segment)); err != nil {
+			logger.ERROR("[#history#] remove segment %s error, %s", segment, err)
+			continue
+		}
+		total -= sizes[segment]
+		for runid, index := range store.index {
+			if index.Segment == segment {
+				delete(store.index, runid)
+			}
+		}
+		logger.INFO("[#history#] remove segment %s", segment)
+	}
+}
+
+func (store *RunStore) segmentSize() int64 {
+
+	size := store.MaxSize / 8
+	if size < 1024*1024 {
+		size = 1024 * 1024
+	}
+	return size
+}
+
+//segments return segment file names, sorted by create time asc.
+func (store *RunStore) segments() []string {
+
+	segments := []string{}
+	fis, err := ioutil.ReadDir(store.Root)
+	if err != nil {
+		return segments
+	}
+
+	for _, fi := range fis {
+		name := fi.Name()
+		if !fi.IsDir() && strings.HasPrefix(name, segmentPrefix) && strings.HasSuffix(name, segmentSuffix) {
+			segments = append(segments, name)
+		}
+	}
+	sort.Strings(segments)
+	return segments
+}
+
+func outputDirectory(segment string) string {
+
+	return strings.TrimSuffix(segment, segmentSuffix) + outputSuffix
+}
+
+func pathSize(path string) int64 {
+
+	var size int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+//truncate keep the tail of output, the end of output is usually most useful.
+func truncate(data string, size int) string {
+
+	if size > 0 && len(data) > size {
+		return "...(truncated)\n" + data[len(data)-size:]
+	}
+	return data
+}
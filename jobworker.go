@@ -69,6 +69,7 @@ func NewJobWorker() (*JobWorker, error) {
 	api.RegisterStore("SystemConfig", etc.SystemConfig)
 	api.RegisterStore("Cache", nodeServer.Cache)
 	api.RegisterStore("Driver", nodeServer.Driver)
+	api.RegisterStore("History", nodeServer.History)
 	api.RegisterStore("NodeKey", nodeServer.Key)
 	api.RegisterStore("NodeData", nodeServer.Data)
 	apiServer := api.NewServer(etc.SystemConfig.API.Hosts, etc.SystemConfig.API.EnableCors, nil)
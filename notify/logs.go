@@ -34,7 +34,8 @@ func (sender *NotifySender) SendLog(jobid string, command string, workdir string
 	entry := &NotifyEntry{
 		NotifyType: NOTIFY_LOG,
 		MsgID:      msgid,
+		JobID:      jobid,
 		Data:       jobLog,
 	}
-	sender.syncQueue.Push(entry)
+	sender.queue.Push(entry)
 }
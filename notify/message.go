@@ -32,9 +32,10 @@ func (sender *NotifySender) SendExecuteMessage(jobid string, state int, execerr
 	entry := &NotifyEntry{
 		NotifyType: NOTIFY_MESSAGE,
 		MsgID:      msgid,
+		JobID:      jobid,
 		Data:       jobExecute,
 	}
-	sender.syncQueue.Push(entry)
+	sender.queue.Push(entry)
 }
 
 //SendSelectMessage is exported
@@ -56,7 +57,99 @@ func (sender *NotifySender) SendSelectMessage(jobid string, nextat time.Time) {
 	entry := &NotifyEntry{
 		NotifyType: NOTIFY_MESSAGE,
 		MsgID:      msgid,
+		JobID:      jobid,
 		Data:       jobSelect,
 	}
-	sender.syncQueue.Push(entry)
+	sender.queue.Push(entry)
+}
+
+//NodeDrain is exported
+//agent drain progress message.
+type NodeDrain struct {
+	models.MsgHeader
+	Location  string    `json:"location"`
+	Key       string    `json:"key"`
+	IPAddr    string    `json:"ipaddr"`
+	State     string    `json:"state"`
+	Running   int       `json:"running"`
+	Stopped   int       `json:"stopped"`
+	Deadline  time.Time `json:"deadline"`
+	Timestamp int64     `json:"timestamp"`
+}
+
+//MsgNodeDrain is exported
+const MsgNodeDrain = "MsgNodeDrain"
+
+//SendDrainMessage is exported
+func (sender *NotifySender) SendDrainMessage(state string, running int, stopped int, deadline time.Time) {
+
+	msgid := rand.UUID(true)
+	logger.INFO("[#notify#] message %s drain %s, running %d stopped %d deadline %s", msgid[:8], state, running, stopped, deadline.Format("2006-01-02 15:04:05"))
+	nodeDrain := &NodeDrain{
+		MsgHeader: models.MsgHeader{
+			MsgName: MsgNodeDrain,
+			MsgId:   msgid,
+		},
+		Location:  sender.Runtime,
+		Key:       sender.Key,
+		IPAddr:    sender.IPAddr,
+		State:     state,
+		Running:   running,
+		Stopped:   stopped,
+		Deadline:  deadline,
+		Timestamp: time.Now().UnixNano(),
+	}
+
+	entry := &NotifyEntry{
+		NotifyType: NOTIFY_MESSAGE,
+		MsgID:      msgid,
+		Data:       nodeDrain,
+	}
+	sender.queue.Push(entry)
+}
+
+//JobWarning is exported
+//job timeout warning message, the job is still running.
+type JobWarning struct {
+	models.MsgHeader
+	JobId     string    `json:"jobid"`
+	Location  string    `json:"location"`
+	Key       string    `json:"key"`
+	IPAddr    string    `json:"ipaddr"`
+	Warning   string    `json:"warning"`
+	ExecAt    time.Time `json:"execat"`
+	ExecTimes float64   `json:"exectimes"`
+	Timestamp int64     `json:"timestamp"`
+}
+
+//MsgJobWarning is exported
+const MsgJobWarning = "MsgJobWarning"
+
+//SendWarningMessage is exported
+func (sender *NotifySender) SendWarningMessage(jobid string, warning string, execat time.Time, exectimes float64) {
+
+	msgid := rand.UUID(true)
+	logger.INFO("[#notify#] message %s job %s, warning execat %s exectimes %.0f", msgid[:8], jobid, execat.Format("2006-01-02 15:04:05"), exectimes)
+	jobWarning := &JobWarning{
+		MsgHeader: models.MsgHeader{
+			MsgName: MsgJobWarning,
+			MsgId:   msgid,
+		},
+		JobId:     jobid,
+		Location:  sender.Runtime,
+		Key:       sender.Key,
+		IPAddr:    sender.IPAddr,
+		Warning:   warning,
+		ExecAt:    execat,
+		ExecTimes: exectimes,
+		Timestamp: time.Now().UnixNano(),
+	}
+
+	entry := &NotifyEntry{
+		NotifyType: NOTIFY_MESSAGE,
+		MsgID:      msgid,
+		JobID:      jobid,
+		Data:       jobWarning,
+	}
+	sender.queue.Push(entry)
 }
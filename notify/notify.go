@@ -1,6 +1,5 @@
 package notify
 
-import "github.com/cloudtask/libtools/gounits/container"
 import "github.com/cloudtask/libtools/gounits/httpx"
 import "github.com/cloudtask/libtools/gounits/logger"
 
@@ -11,6 +10,9 @@ import (
 	"time"
 )
 
+//单次通知请求超时时长
+const sendTimeout = 30 * time.Second
+
 //NotifySender is exported
 type NotifySender struct {
 	Runtime    string
@@ -18,11 +20,14 @@ type NotifySender struct {
 	IPAddr     string
 	CenterHost string
 	client     *httpx.HttpClient
-	syncQueue  *container.SyncQueue
+	queue      *NotifyQueue
+	ctx        context.Context
+	cancel     context.CancelFunc
 }
 
 //NewNotifySender is exported
-func NewNotifySender(centerHost string, runtime string, key string, ipAddr string) *NotifySender {
+//notifies are persisted under root/notify and sent in order of each job until center accepted.
+func NewNotifySender(root string, centerHost string, runtime string, key string, ipAddr string) *NotifySender {
 
 	client := httpx.NewClient().
 		SetTransport(&http.Transport{
@@ -39,60 +44,69 @@ func NewNotifySender(centerHost string, runtime string, key string, ipAddr strin
 			ExpectContinueTimeout: http.DefaultTransport.(*http.Transport).ExpectContinueTimeout,
 		})
 
+	ctx, cancel := context.WithCancel(context.Background())
 	notifySender := &NotifySender{
 		Runtime:    runtime,
 		Key:        key,
 		IPAddr:     ipAddr,
 		CenterHost: centerHost,
 		client:     client,
-		syncQueue:  container.NewSyncQueue(),
+		ctx:        ctx,
+		cancel:     cancel,
 	}
-	go notifySender.doPopLoop()
+	notifySender.queue = newNotifyQueue(root+"/notify", notifySender.sendEntry)
 	return notifySender
 }
 
-func (sender *NotifySender) doPopLoop() {
+//Close is exported
+//stop sending, pending notifies are sent after restart.
+func (sender *NotifySender) Close() {
 
-	for {
-		value := sender.syncQueue.Pop()
-		if value != nil {
-			entry := value.(*NotifyEntry)
-			switch entry.NotifyType {
-			case NOTIFY_MESSAGE:
-				go sender.sendMessage(entry.MsgID, entry.Data)
-			case NOTIFY_LOG:
-				go sender.sendLog(entry.MsgID, entry.Data)
-			}
-		}
-	}
+	logger.INFO("[#notify#] sender close, %d notifies pending.", sender.queue.Len())
+	sender.queue.Close()
+	sender.cancel()
 }
 
-func (sender *NotifySender) sendMessage(msgid string, data interface{}) {
+//sendEntry send a queue entry, return true when center response 2xx or rejected it permanently.
+func (sender *NotifySender) sendEntry(entry *queueEntry) bool {
 
-	resp, err := sender.client.PostJSON(context.Background(), sender.CenterHost+"/cloudtask/v2/messages", nil, data, nil)
-	if err != nil {
-		logger.ERROR("[#notify#] message request %s error, %s", msgid, err.Error())
-		return
-	}
-
-	defer resp.Close()
-	statusCode := resp.StatusCode()
-	if statusCode >= http.StatusBadRequest {
-		logger.ERROR("[#notify#] message request %s failure, %d", msgid, statusCode)
+	switch entry.NotifyType {
+	case NOTIFY_MESSAGE:
+		return sender.send("message", "/cloudtask/v2/messages", entry.MsgID, entry.Data)
+	case NOTIFY_LOG:
+		return sender.send("logs", "/cloudtask/v2/logs", entry.MsgID, entry.Data)
 	}
+	logger.ERROR("[#notify#] unknown notify type %d, %s dropped.", entry.NotifyType, entry.MsgID)
+	return true
 }
 
-func (sender *NotifySender) sendLog(msgid string, data interface{}) {
+/*
+send 发送通知, 返回true时从队列删除
+1、center返回2xx表示已接收
+2、center返回4xx(408、429除外)表示消息本身被拒绝, 重试不会成功, 记录后丢弃
+3、网络错误、5xx、408与429稍后重试
+*/
+func (sender *NotifySender) send(name string, path string, msgid string, data interface{}) bool {
 
-	resp, err := sender.client.PostJSON(context.Background(), sender.CenterHost+"/cloudtask/v2/logs", nil, data, nil)
+	ctx, cancel := context.WithTimeout(sender.ctx, sendTimeout)
+	defer cancel()
+	resp, err := sender.client.PostJSON(ctx, sender.CenterHost+path, nil, data, nil)
 	if err != nil {
-		logger.ERROR("[#notify#] logs request %s error, %s", msgid, err.Error())
-		return
+		logger.ERROR("[#notify#] %s request %s error, %s", name, msgid, err.Error())
+		return false
 	}
 
 	defer resp.Close()
 	statusCode := resp.StatusCode()
-	if statusCode >= http.StatusBadRequest {
-		logger.ERROR("[#notify#] logs request %s failure, %d", msgid, statusCode)
+	if statusCode >= http.StatusBadRequest && statusCode < http.StatusInternalServerError &&
+		statusCode != http.StatusRequestTimeout && statusCode != http.StatusTooManyRequests {
+		logger.ERROR("[#notify#] %s request %s rejected, %d, dropped.", name, msgid, statusCode)
+		return true
+	}
+
+	if statusCode < http.StatusOK || statusCode >= http.StatusMultipleChoices {
+		logger.ERROR("[#notify#] %s request %s failure, %d", name, msgid, statusCode)
+		return false
 	}
+	return true
 }
@@ -0,0 +1,484 @@
+package notify
+
+import "github.com/cloudtask/libtools/gounits/logger"
+
+import (
+	"bufio"
+	"encoding/json"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	//队列日志文件名(JSON Lines)
+	queueFile = "notify.wal"
+	//压缩时的临时文件后缀
+	queueTempSuffix = ".tmp"
+	//日志中已完成记录超过该数量且超过未完成数时压缩
+	queueCompactMin = 1024
+	//失败重试初始间隔
+	retryBaseInterval = 1 * time.Second
+	//失败重试最大间隔
+	retryMaxInterval = 5 * time.Minute
+	//重试检查间隔
+	retryTickInterval = 1 * time.Second
+	//并发发送数
+	queueParallel = 8
+	//未完成消息的数据总字节数上限, 超过时丢弃最早的消息
+	queueMaxSize = 64 << 20
+	//超过上限时丢弃到该字节数以下, 避免每次追加都触发丢弃
+	queueTrimSize = queueMaxSize / 10 * 9
+)
+
+const (
+	queueOpAdd  = "add"
+	queueOpDone = "done"
+)
+
+/*
+queueRecord 队列日志记录
+add记录携带消息内容, done记录表示该seq已被center确认(2xx)
+*/
+type queueRecord struct {
+	Op         string          `json:"op"`
+	Seq        uint64          `json:"seq"`
+	NotifyType NotifyType      `json:"type,omitempty"`
+	MsgID      string          `json:"msgid,omitempty"`
+	JobID      string          `json:"jobid,omitempty"`
+	Data       json.RawMessage `json:"data,omitempty"`
+}
+
+//queueEntry a pending notify, attempts and nextAt are memory only.
+type queueEntry struct {
+	*queueRecord
+	attempts int
+	nextAt   time.Time
+}
+
+//jobQueue notifies of a job, only the head is sending to keep job order.
+type jobQueue struct {
+	entries []*queueEntry
+	sending bool
+}
+
+/*
+NotifyQueue is exported
+持久化通知队列
+1、消息先追加写入SaveDirectory/notify/notify.wal并fsync, 重启后重放未完成的消息
+2、同一job的消息按顺序发送, 前一条成功(2xx)后才发送下一条, 不同job并发发送
+3、发送失败按指数退避重试, center返回2xx或永久拒绝(4xx)才删除
+4、未完成消息超过queueMaxSize时丢弃最早的消息(正在发送的除外), center长时间不可用时不会占满磁盘
+*/
+type NotifyQueue struct {
+	sync.Mutex
+	Root    string
+	fd      *os.File
+	seq     uint64
+	done    int
+	size    int64
+	jobs    map[string]*jobQueue
+	tasks   chan *queueEntry
+	wakeCh  chan struct{}
+	quit    chan struct{}
+	quited  bool
+	handler func(entry *queueEntry) bool
+}
+
+//newNotifyQueue open queue under root and replay pending notifies, handler return true when notify finished(sent or rejected).
+func newNotifyQueue(root string, handler func(entry *queueEntry) bool) *NotifyQueue {
+
+	queue := &NotifyQueue{
+		Root:    root,
+		jobs:    make(map[string]*jobQueue),
+		tasks:   make(chan *queueEntry),
+		wakeCh:  make(chan struct{}, 1),
+		quit:    make(chan struct{}),
+		handler: handler,
+	}
+
+	if err := queue.open(); err != nil {
+		logger.ERROR("[#notify#] queue open %s error, %s, notifies are kept in memory only.", root, err.Error())
+	}
+
+	go queue.schedule()
+	for i := 0; i < queueParallel; i++ {
+		go queue.work()
+	}
+	return queue
+}
+
+//open replay queue file and rewrite it with pending notifies only.
+func (queue *NotifyQueue) open() error {
+
+	if err := os.MkdirAll(queue.Root, 0777); err != nil {
+		return err
+	}
+
+	records := map[uint64]*queueRecord{}
+	if fd, err := os.Open(queue.Root + "/" + queueFile); err == nil {
+		scanner := bufio.NewScanner(fd)
+		scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+		for scanner.Scan() {
+			record := &queueRecord{}
+			if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+				continue //崩溃时未写完的记录
+			}
+			if record.Seq > queue.seq {
+				queue.seq = record.Seq
+			}
+			switch record.Op {
+			case queueOpAdd:
+				records[record.Seq] = record
+			case queueOpDone:
+				delete(records, record.Seq)
+			}
+		}
+		fd.Close()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	pending := []*queueRecord{}
+	for _, record := range records {
+		pending = append(pending, record)
+	}
+
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].Seq < pending[j].Seq
+	})
+
+	for _, record := range pending {
+		queue.append(&queueEntry{queueRecord: record})
+	}
+	queue.trim()
+
+	if len(pending) > 0 {
+		logger.INFO("[#notify#] queue replay %d pending notifies.", len(pending))
+	}
+	return queue.compact()
+}
+
+//append add entry to its job queue, queue lock must be held.
+func (queue *NotifyQueue) append(entry *queueEntry) {
+
+	jobqueue, ret := queue.jobs[entry.JobID]
+	if !ret {
+		jobqueue = &jobQueue{entries: []*queueEntry{}}
+		queue.jobs[entry.JobID] = jobqueue
+	}
+	jobqueue.entries = append(jobqueue.entries, entry)
+	queue.size += int64(len(entry.Data))
+}
+
+//trim drop oldest pending entries which are not sending when queue size exceed, queue lock must be held.
+func (queue *NotifyQueue) trim() {
+
+	if queue.size <= queueMaxSize {
+		return
+	}
+
+	dropped := 0
+	for _, entry := range queue.pending() {
+		if queue.size <= queueTrimSize {
+			break
+		}
+		jobqueue := queue.jobs[entry.JobID]
+		index := 0
+		for index < len(jobqueue.entries) && jobqueue.entries[index] != entry {
+			index++
+		}
+		if index == 0 && jobqueue.sending {
+			continue
+		}
+		jobqueue.entries = append(jobqueue.entries[:index], jobqueue.entries[index+1:]...)
+		if len(jobqueue.entries) == 0 {
+			delete(queue.jobs, entry.JobID)
+		}
+		queue.size -= int64(len(entry.Data))
+		if queue.fd != nil {
+			queue.write(&queueRecord{Op: queueOpDone, Seq: entry.Seq}, false)
+			queue.done++
+		}
+		dropped++
+	}
+	logger.WARN("[#notify#] queue size exceed %d, %d oldest notifies dropped.", queueMaxSize, dropped)
+}
+
+/*
+compact 重写队列日志, 只保留未完成的消息
+写入临时文件并fsync后rename, queue锁需已持有(open时除外).
+*/
+func (queue *NotifyQueue) compact() error {
+
+	fpath := queue.Root + "/" + queueFile
+	temp := fpath + queueTempSuffix
+	fd, err := os.OpenFile(temp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(fd)
+	encoder := json.NewEncoder(writer)
+	for _, entry := range queue.pending() {
+		if err = encoder.Encode(entry.queueRecord); err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		if err = writer.Flush(); err == nil {
+			err = fd.Sync()
+		}
+	}
+	fd.Close()
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+
+	if err := os.Rename(temp, fpath); err != nil {
+		os.Remove(temp)
+		return err
+	}
+	syncDirectory(filepath.Dir(fpath))
+
+	if queue.fd != nil {
+		queue.fd.Close()
+	}
+	queue.fd, err = os.OpenFile(fpath, os.O_WRONLY|os.O_APPEND, 0666)
+	queue.done = 0
+	return err
+}
+
+//pending return all pending entries order by seq.
+func (queue *NotifyQueue) pending() []*queueEntry {
+
+	entries := []*queueEntry{}
+	for _, jobqueue := range queue.jobs {
+		entries = append(entries, jobqueue.entries...)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Seq < entries[j].Seq
+	})
+	return entries
+}
+
+//write append a record to queue file, sync is required for add records.
+func (queue *NotifyQueue) write(record *queueRecord, sync bool) error {
+
+	if queue.fd == nil {
+		return os.ErrClosed
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	if _, err = queue.fd.Write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	if sync {
+		return queue.fd.Sync()
+	}
+	return nil
+}
+
+//Push is exported
+//persist a notify and wake up sending, the notify is kept in memory if persist failed.
+func (queue *NotifyQueue) Push(entry *NotifyEntry) {
+
+	data, err := json.Marshal(entry.Data)
+	if err != nil {
+		logger.ERROR("[#notify#] queue encode %s error, %s", entry.MsgID, err.Error())
+		return
+	}
+
+	queue.Lock()
+	if queue.quited {
+		queue.Unlock()
+		logger.WARN("[#notify#] queue closed, %s dropped.", entry.MsgID)
+		return
+	}
+
+	queue.seq++
+	record := &queueRecord{
+		Op:         queueOpAdd,
+		Seq:        queue.seq,
+		NotifyType: entry.NotifyType,
+		MsgID:      entry.MsgID,
+		JobID:      entry.JobID,
+		Data:       data,
+	}
+
+	if err := queue.write(record, true); err != nil {
+		logger.ERROR("[#notify#] queue persist %s error, %s", entry.MsgID, err.Error())
+	}
+	queue.append(&queueEntry{queueRecord: record})
+	queue.trim()
+	queue.Unlock()
+	queue.wake()
+}
+
+//Len is exported
+//return pending notifies count.
+func (queue *NotifyQueue) Len() int {
+
+	queue.Lock()
+	defer queue.Unlock()
+	count := 0
+	for _, jobqueue := range queue.jobs {
+		count += len(jobqueue.entries)
+	}
+	return count
+}
+
+//Close is exported
+//stop sending, pending notifies are kept in queue file and sent after restart.
+func (queue *NotifyQueue) Close() {
+
+	queue.Lock()
+	defer queue.Unlock()
+	if queue.quited {
+		return
+	}
+
+	queue.quited = true
+	close(queue.quit)
+	if queue.fd != nil {
+		queue.fd.Close()
+		queue.fd = nil
+	}
+}
+
+func (queue *NotifyQueue) wake() {
+
+	select {
+	case queue.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
+//schedule dispatch due job queue heads to workers.
+func (queue *NotifyQueue) schedule() {
+
+	ticker := time.NewTicker(retryTickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-queue.quit:
+			return
+		case <-queue.wakeCh:
+		case <-ticker.C:
+		}
+
+		for _, entry := range queue.due() {
+			select {
+			case queue.tasks <- entry:
+			case <-queue.quit:
+				return
+			}
+		}
+	}
+}
+
+//due mark due job queue heads sending, order by seq.
+func (queue *NotifyQueue) due() []*queueEntry {
+
+	queue.Lock()
+	defer queue.Unlock()
+	now := time.Now()
+	entries := []*queueEntry{}
+	for _, jobqueue := range queue.jobs {
+		if jobqueue.sending || len(jobqueue.entries) == 0 {
+			continue
+		}
+		if head := jobqueue.entries[0]; !now.Before(head.nextAt) {
+			jobqueue.sending = true
+			entries = append(entries, head)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Seq < entries[j].Seq
+	})
+	return entries
+}
+
+func (queue *NotifyQueue) work() {
+
+	for {
+		select {
+		case <-queue.quit:
+			return
+		case entry := <-queue.tasks:
+			queue.finish(entry, queue.handler(entry))
+		}
+	}
+}
+
+//finish remove a sent entry, or schedule a retry with backoff.
+func (queue *NotifyQueue) finish(entry *queueEntry, sent bool) {
+
+	queue.Lock()
+	defer queue.Unlock()
+	jobqueue, ret := queue.jobs[entry.JobID]
+	if !ret || len(jobqueue.entries) == 0 || jobqueue.entries[0] != entry {
+		return
+	}
+
+	jobqueue.sending = false
+	if !sent {
+		entry.attempts++
+		entry.nextAt = time.Now().Add(retryBackoff(entry.attempts))
+		logger.WARN("[#notify#] queue %s failed %d times, retry at %s.", entry.MsgID, entry.attempts, entry.nextAt.Format(time.RFC3339))
+		return
+	}
+
+	jobqueue.entries = jobqueue.entries[1:]
+	queue.size -= int64(len(entry.Data))
+	if len(jobqueue.entries) == 0 {
+		delete(queue.jobs, entry.JobID)
+	}
+
+	if queue.quited {
+		return
+	}
+
+	if err := queue.write(&queueRecord{Op: queueOpDone, Seq: entry.Seq}, false); err != nil {
+		logger.ERROR("[#notify#] queue persist %s done error, %s", entry.MsgID, err.Error())
+	}
+
+	queue.done++
+	if queue.done >= queueCompactMin && queue.done > len(queue.pending()) {
+		if err := queue.compact(); err != nil {
+			logger.ERROR("[#notify#] queue compact error, %s", err.Error())
+		}
+	}
+	queue.wake()
+}
+
+/*
+retryBackoff 指数退避
+第n次失败后等待 base*2^(n-1), 最大不超过retryMaxInterval, 并加入随机抖动.
+*/
+func retryBackoff(attempts int) time.Duration {
+
+	if attempts > 16 {
+		attempts = 16
+	}
+
+	backoff := retryBaseInterval << uint(attempts-1)
+	if backoff > retryMaxInterval {
+		backoff = retryMaxInterval
+	}
+
+	half := int64(backoff / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
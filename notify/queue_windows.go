@@ -0,0 +1,7 @@
+package notify
+
+//syncDirectory windows can not fsync a directory, rename is durable after it returned.
+func syncDirectory(path string) error {
+
+	return nil
+}
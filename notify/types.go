@@ -22,6 +22,7 @@ func (notifyType NotifyType) String() string {
 type NotifyEntry struct {
 	NotifyType
 	MsgID   string
+	JobID   string //同一job的通知按顺序发送, 为空的通知(如drain)共用一个队列
 	To      string
 	Subject string
 	Data    interface{}
@@ -7,6 +7,7 @@ import "github.com/cloudtask/libtools/gzkwrapper"
 import "github.com/cloudtask/common/models"
 
 import (
+	"path/filepath"
 	"time"
 )
 
@@ -73,6 +74,12 @@ func (server *NodeServer) OnJobCacheExceptionHandlerFunc(event cache.CacheEvent,
 func (server *NodeServer) OnDriverExecuteHandlerFunc(state int, context *driver.DriverContext) {
 
 	logger.INFO("[#server#] driver execute, job %s state %s", context.Job.JobId, models.GetStateString(state))
+	if state == models.STATE_STARTED { //执行期间保留工作目录, 版本变更不会清理正在使用的文件
+		server.Cache.PinJobDirectory(context.Job.JobId, filepath.Base(context.WorkDir))
+	} else {
+		server.Cache.UnpinJobDirectory(context.Job.JobId)
+	}
+	server.appendRunHistory(state, context)
 	server.Notify.SendExecuteMessage(context.Job.JobId, state, context.ExecErr, context.ExecAt, context.NextAt)
 	//当状态为: STATE_STARTED, 忽略日志与发邮件.
 	//当状态为: STATE_STOPED | STATE_FAILED, 记录日志，处理邮件通知.
@@ -92,3 +99,15 @@ func (server *NodeServer) OnDriverStopedHandlerFunc(state int, context *driver.D
 	logger.INFO("[#server#] driver stoped, job %s", context.Job.JobId)
 	server.Notify.SendExecuteMessage(context.Job.JobId, state, context.ExecErr, context.ExecAt, context.NextAt)
 }
+
+func (server *NodeServer) OnDriverTimeoutWarningHandlerFunc(context *driver.DriverContext) {
+
+	logger.WARN("[#server#] driver timeout warning, job %s exectimes %.0f", context.Job.JobId, context.ExecTimes)
+	server.Notify.SendWarningMessage(context.Job.JobId, context.ExecErr, context.ExecAt, context.ExecTimes)
+}
+
+func (server *NodeServer) OnDriverDrainHandlerFunc(status driver.DrainStatus) {
+
+	logger.INFO("[#server#] driver drain %s, running %d stopped %d", status.State, status.Running, status.Stopped)
+	server.Notify.SendDrainMessage(status.State.String(), status.Running, status.Stopped, status.Deadline)
+}
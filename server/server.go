@@ -3,12 +3,17 @@ package server
 import "github.com/cloudtask/cloudtask-agent/cache"
 import "github.com/cloudtask/cloudtask-agent/driver"
 import "github.com/cloudtask/cloudtask-agent/etc"
+import "github.com/cloudtask/cloudtask-agent/history"
 import "github.com/cloudtask/cloudtask-agent/notify"
 import "github.com/cloudtask/libtools/gounits/logger"
 import "github.com/cloudtask/libtools/gzkwrapper"
 import "github.com/cloudtask/common/models"
 
 import (
+	"bytes"
+	"encoding/json"
+	"path"
+	"strings"
 	"time"
 )
 
@@ -30,6 +35,7 @@ type NodeServer struct {
 	Cache      *cache.Cache
 	Driver     *driver.Driver
 	Notify     *notify.NotifySender
+	History    *history.RunStore
 	stopCh     chan struct{}
 	gzkwrapper.INodeNotifyHandler
 	cache.ICacheHandler
@@ -48,6 +54,10 @@ func NewNodeServer(key string) (*NodeServer, error) {
 		stopCh:     make(chan struct{}),
 	}
 
+	if etc.CacheConfigs().AllocNode { //每个节点独立的分配表节点, 只包含本节点的任务
+		server.AllocPath = server.AllocPath + "/" + key
+	}
+
 	worker, err := gzkwrapper.NewWorker(key, clusterConfigs, server)
 	if err != nil {
 		return nil, err
@@ -57,8 +67,9 @@ func NewNodeServer(key string) (*NodeServer, error) {
 	server.Data = worker.Data
 	cacheConfigs := etc.CacheConfigs()
 	server.Cache = cache.NewCache(cacheConfigs, server)
-	server.Driver = driver.NewDirver(cacheConfigs.SaveDirectory, server)
-	server.Notify = notify.NewNotifySender(etc.CenterHost(), clusterConfigs.Location, key, worker.Data.IpAddr)
+	server.Driver = driver.NewDirver(etc.DriverConfigs(), server)
+	server.Notify = notify.NewNotifySender(cacheConfigs.SaveDirectory, etc.CenterHost(), clusterConfigs.Location, key, worker.Data.IpAddr)
+	server.History = history.NewRunStore(etc.HistoryConfigs())
 	return server, nil
 }
 
@@ -66,13 +77,16 @@ func NewNodeServer(key string) (*NodeServer, error) {
 func (server *NodeServer) Startup() error {
 
 	var err error
+	offline := false
 	defer func() {
 		if err != nil {
 			server.nodeUnRegister()
 			return
 		}
-		//start cache alloc monitor loop.
-		go server.monitorCacheAllocLoop()
+		if !offline { //离线启动时由reconnectLoop在注册成功后启动
+			//start cache alloc monitor loop.
+			go server.monitorCacheAllocLoop()
+		}
 		//start driver dispatch loop.
 		go server.dispatchDriverLoop()
 	}()
@@ -80,6 +94,12 @@ func (server *NodeServer) Startup() error {
 	if err = server.nodeRegister(); err != nil {
 		logger.ERROR("[#server#] server register to cluster error, %s", err)
 		server.Worker.Close()
+		if etc.CacheConfigs().OfflineMode {
+			if offline = server.startupOffline() == nil; offline {
+				err = nil
+				return nil
+			}
+		}
 		return err
 	}
 
@@ -87,6 +107,14 @@ func (server *NodeServer) Startup() error {
 		server.initServerConfig()
 	}
 
+	if err = server.History.Open(); err != nil {
+		logger.ERROR("[#server#] server open run history error, %s", err)
+		return err
+	}
+
+	//recover job processes which still running after agent restart.
+	server.Driver.Recover()
+
 	if err = server.openCache(); err != nil {
 		logger.ERROR("[#server#] server open cache error, %s", err)
 		return err
@@ -94,13 +122,81 @@ func (server *NodeServer) Startup() error {
 	return nil
 }
 
+/*
+startupOffline 集群不可达时离线启动
+从本地恢复最后一次生效的分配表继续调度, 后台重试注册, 注册成功后以集群分配表对账.
+*/
+func (server *NodeServer) startupOffline() error {
+
+	logger.WARN("[#server#] cluster unreachable, startup offline.")
+	if err := server.History.Open(); err != nil {
+		logger.ERROR("[#server#] server open run history error, %s", err)
+		return err
+	}
+
+	server.Driver.Recover()
+	server.Cache.LoadJobs()
+	version, err := server.Cache.RestoreAlloc(server.Key)
+	if err != nil {
+		logger.ERROR("[#server#] restore offline alloc error, %s", err)
+		server.History.Close()
+		return err
+	}
+
+	logger.INFO("[#server#] offline alloc restored, version is %d", version)
+	go server.reconnectLoop()
+	return nil
+}
+
+//reconnectLoop retry register to cluster after offline startup, then open cache alloc watching.
+func (server *NodeServer) reconnectLoop() {
+
+	for {
+		runTicker := time.NewTicker(refreshAllocInterval)
+		select {
+		case <-runTicker.C:
+			{
+				runTicker.Stop()
+				if err := server.nodeRegister(); err != nil {
+					logger.WARN("[#server#] offline reconnect cluster error, %s", err)
+					server.Worker.Close()
+					continue
+				}
+				if etc.UseServerConfig() {
+					server.initServerConfig()
+				}
+				if err := server.attachCacheAlloc(); err != nil {
+					logger.ERROR("[#server#] offline reconnect open cache alloc error, %s", err)
+					server.Worker.WatchClose(server.AllocPath)
+					server.closeServerConfig()
+					server.nodeUnRegister()
+					continue
+				}
+				logger.INFO("[#server#] offline reconnected to cluster.")
+				go server.monitorCacheAllocLoop()
+				return
+			}
+		case <-server.stopCh:
+			{
+				runTicker.Stop()
+				logger.INFO("[#server] offline reconnect loop exited.")
+				return
+			}
+		}
+	}
+}
+
 //Stop is exported
 func (server *NodeServer) Stop() error {
 
+	//stop dispatching new runs, wait running jobs finished or drain deadline.
+	server.Driver.Drain()
 	close(server.stopCh)
 	server.closeServerConfig()
 	server.Driver.Clear()
+	server.History.Close()
 	server.closeCache()
+	server.Notify.Close()
 	if err := server.nodeUnRegister(); err != nil {
 		logger.ERROR("[#server] unregister to cluster error, %s", err.Error())
 		return err
@@ -115,10 +211,42 @@ func (server *NodeServer) nodeRegister() error {
 		return err
 	}
 
-	attach := models.AttachEncode(&models.AttachData{
-		JobMaxCount: etc.CacheConfigs().MaxJobs,
+	return server.Worker.Signin(server.makeAttach())
+}
+
+/*
+NodeAttach is exported
+节点附加数据, 在AttachData基础上携带当前负载, 中心可据此重新均衡分配.
+*/
+type NodeAttach struct {
+	models.AttachData
+	JobCount    int `json:"jobcount"`    //已激活的任务数
+	RejectCount int `json:"rejectcount"` //超过容量被拒绝的任务数
+}
+
+//makeAttach encode node attach data with current load.
+func (server *NodeServer) makeAttach() []byte {
+
+	jobs, rejects, _ := server.Cache.GetLoad()
+	attach, err := json.Marshal(&NodeAttach{
+		AttachData:  models.AttachData{JobMaxCount: etc.CacheConfigs().MaxJobs},
+		JobCount:    jobs,
+		RejectCount: rejects,
 	})
-	return server.Worker.Signin(attach)
+	if err != nil {
+		return models.AttachEncode(&models.AttachData{JobMaxCount: etc.CacheConfigs().MaxJobs})
+	}
+	return attach
+}
+
+//refreshAttach update node attach data, reported to cluster with the next pulse.
+func (server *NodeServer) refreshAttach() {
+
+	attach := server.makeAttach()
+	if !bytes.Equal(server.Data.Attach, attach) {
+		server.Data.Attach = attach
+		logger.INFO("[#server#] node attach changed, %s", attach)
+	}
 }
 
 //nodeUnRegister is exported
@@ -178,6 +306,14 @@ func (server *NodeServer) openCache() error {
 
 	logger.INFO("[#server] server initialize......")
 	server.Cache.LoadJobs()
+	return server.attachCacheAlloc()
+}
+
+//attachCacheAlloc is exported
+//watch cluster jobs alloc and initialize cache alloc.
+func (server *NodeServer) attachCacheAlloc() error {
+
+	server.RefreshCachePeers()
 
 	//init alloc path.
 	if err := server.makeAllocPath(); err != nil {
@@ -216,7 +352,17 @@ func (server *NodeServer) closeCache() {
 //makeAllocPath is exported
 func (server *NodeServer) makeAllocPath() error {
 
-	ret, err := server.Worker.Exists(server.AllocPath)
+	if etc.CacheConfigs().AllocNode { //先创建runtime分配表节点
+		if err := server.makeAllocNode(path.Dir(server.AllocPath)); err != nil {
+			return err
+		}
+	}
+	return server.makeAllocNode(server.AllocPath)
+}
+
+func (server *NodeServer) makeAllocNode(allocPath string) error {
+
+	ret, err := server.Worker.Exists(allocPath)
 	if err != nil {
 		return err
 	}
@@ -226,7 +372,7 @@ func (server *NodeServer) makeAllocPath() error {
 		if err != nil {
 			return err
 		}
-		return server.Worker.Create(server.AllocPath, data)
+		return server.Worker.Create(allocPath, data)
 	}
 	return nil
 }
@@ -248,6 +394,49 @@ func (server *NodeServer) RefreshCacheAlloc() (int, error) {
 	return version, nil
 }
 
+//RefreshCachePeers is exported
+//discover agents of the same runtime from cluster, cache pull jobfiles from them first.
+func (server *NodeServer) RefreshCachePeers() {
+
+	if !etc.SystemConfig.Cache.PeerShare {
+		return
+	}
+
+	children, err := server.Worker.Children(server.Worker.Root)
+	if err != nil {
+		logger.ERROR("[#server#] refresh cache peers error, %s", err)
+		return
+	}
+
+	peers := []string{}
+	for _, child := range children {
+		path := server.Worker.Root + "/" + child
+		if path == server.Worker.Path {
+			continue
+		}
+		data, err := server.Worker.Get(path)
+		if err != nil {
+			continue
+		}
+		nodedata := &gzkwrapper.NodeData{}
+		if err := json.Unmarshal(data, nodedata); err != nil {
+			continue
+		}
+		if nodedata.Location != server.Runtime || nodedata.APIAddr == "" {
+			continue
+		}
+		apiaddr := nodedata.APIAddr
+		if strings.HasPrefix(apiaddr, ":") {
+			apiaddr = nodedata.IpAddr + apiaddr
+		}
+		if apiaddr == server.Data.IpAddr+server.Data.APIAddr {
+			continue
+		}
+		peers = append(peers, "http://"+apiaddr)
+	}
+	server.Cache.SetPeers(peers)
+}
+
 //monitorCacheAllocLoop is exported
 func (server *NodeServer) monitorCacheAllocLoop() {
 
@@ -257,8 +446,10 @@ func (server *NodeServer) monitorCacheAllocLoop() {
 		case <-runTicker.C:
 			{
 				runTicker.Stop()
+				server.RefreshCachePeers()
 				originVersion := server.Cache.GetAllocVersion()
 				version, err := server.RefreshCacheAlloc()
+				server.refreshAttach() //上报当前负载
 				if err != nil {
 					logger.ERROR("[#server#] monitor jobs alloc %s error, %s", server.AllocPath, err)
 					continue
@@ -315,3 +506,32 @@ func (server *NodeServer) dispatchDriverLoop() {
 		}
 	}
 }
+
+//appendRunHistory is exported
+//append driver execute state to local run history.
+func (server *NodeServer) appendRunHistory(state int, context *driver.DriverContext) {
+
+	if context.RunId == "" {
+		return
+	}
+
+	record := &history.RunRecord{
+		RunId:     context.RunId,
+		JobId:     context.Job.JobId,
+		State:     state,
+		ExecAt:    context.ExecAt,
+		ExecTimes: context.ExecTimes,
+		ExitCode:  context.ExitCode,
+		ExecErr:   context.ExecErr,
+	}
+
+	stdout, errout := "", ""
+	if state != models.STATE_STARTED {
+		record.EndAt = time.Now()
+		stdout, errout = context.StdOut, context.ErrOut
+	}
+
+	if err := server.History.Append(record, stdout, errout); err != nil {
+		logger.ERROR("[#server#] append run history %s error, %s", context.RunId, err)
+	}
+}